@@ -2,7 +2,11 @@ module github.com/woodgear/cdm
 
 go 1.24.4
 
-require github.com/spf13/cobra v1.10.2
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/spf13/cobra v1.10.2
+	golang.org/x/sys v0.13.0
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
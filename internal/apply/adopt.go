@@ -0,0 +1,132 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// AdoptPath returns where an existing file belongs inside a source
+// directory: under home/ for files in the home directory, under root/
+// otherwise
+func AdoptPath(srcDir, file string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	if rel, err := filepath.Rel(home, file); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		return filepath.Join(srcDir, "home", rel), nil
+	}
+	return filepath.Join(srcDir, "root", file), nil
+}
+
+// Adopt moves existing files into a source directory and replaces each
+// with a symlink to its new location, the reverse of apply. Returns the
+// source paths that were (or would be, in dry-run) created.
+func (a *Applier) Adopt(files []string, srcDir string, opts types.ApplyOptions) ([]string, error) {
+	if opts.DryRun {
+		fmt.Printf("[WARN] DRY-RUN MODE: No changes will be made\n")
+	}
+
+	if !opts.DryRun && !opts.NoLock {
+		lock, err := acquireLock()
+		if err != nil {
+			return nil, err
+		}
+		defer lock.release()
+	}
+
+	paths := make([]string, 0, len(files))
+	var system []types.Link
+	for _, f := range files {
+		file, err := filepath.Abs(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		paths = append(paths, file)
+
+		// Only regular files are replaced; the rest fail or are skipped below
+		if info, err := os.Lstat(file); err != nil || !info.Mode().IsRegular() || !fs.NeedsSudo(file) {
+			continue
+		}
+		source, err := AdoptPath(srcDir, file)
+		if err != nil {
+			return nil, err
+		}
+		system = append(system, types.Link{Source: source, Target: file})
+	}
+	if err := confirmSystem("adopt", system, opts); err != nil {
+		return nil, err
+	}
+
+	var adopted []string
+	var failures []string
+	for _, file := range paths {
+		source, err := a.adoptFile(file, srcDir, opts)
+		if err != nil {
+			fmt.Printf("[ERROR] %s\n", err)
+			failures = append(failures, file)
+			continue
+		}
+		if source != "" {
+			adopted = append(adopted, source)
+		}
+	}
+
+	if len(failures) > 0 {
+		return adopted, fmt.Errorf("failed to adopt %d files: %s", len(failures), strings.Join(failures, ", "))
+	}
+	return adopted, nil
+}
+
+// adoptFile copies one file into the source directory and links it back.
+// Returns "" if the file is already managed.
+func (a *Applier) adoptFile(file, srcDir string, opts types.ApplyOptions) (string, error) {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return "", fmt.Errorf("cannot adopt %s: %w", file, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		fmt.Printf("[SKIP] Already a symlink: %s\n", file)
+		return "", nil
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("cannot adopt directory %s: adopt its files, or add it to linkFolders", file)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("cannot adopt %s: not a regular file", file)
+	}
+
+	source, err := AdoptPath(srcDir, file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(source); err == nil {
+		return "", fmt.Errorf("cannot adopt %s: %s already exists", file, source)
+	}
+
+	// Copy rather than rename: works across filesystems, and replacing the
+	// original with the link below escalates privileges if needed
+	copyOpts := opts
+	copyOpts.Backup = false
+	if err := a.sm.CopyFile(source, file, copyOpts); err != nil {
+		return "", err
+	}
+	if err := a.sm.CreateSymlink(file, source, opts); err != nil {
+		if !opts.DryRun {
+			os.Remove(source)
+		}
+		return "", err
+	}
+
+	if opts.DryRun {
+		fmt.Printf("[DRY-RUN] Would adopt: %s -> %s\n", file, source)
+	} else {
+		fmt.Printf("[ADOPT] %s -> %s\n", file, source)
+	}
+	return source, nil
+}
@@ -2,9 +2,16 @@
 package apply
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/woodgear/cdm/internal/fs"
 	"github.com/woodgear/cdm/pkg/types"
@@ -12,8 +19,9 @@ import (
 
 // Applier executes deployment plans
 type Applier struct {
-	verbose bool
-	sm      *fs.SymlinkManager
+	verbose    bool
+	sm         *fs.SymlinkManager
+	lastResult *types.ApplyResult
 }
 
 // NewApplier creates a new plan applier
@@ -24,28 +32,97 @@ func NewApplier(verbose bool) *Applier {
 	}
 }
 
-// ReadPlan reads a plan from a JSON file
+// StdioPlan is the plan file name that refers to stdin/stdout
+const StdioPlan = "-"
+
+// GzipPlanExt marks plan files that are stored gzip-compressed
+const GzipPlanExt = ".gz"
+
+// isGzipPlan reports whether a plan file is read and written compressed
+func isGzipPlan(planFile string) bool {
+	return strings.HasSuffix(planFile, GzipPlanExt)
+}
+
+// ReadPlan reads a plan from a JSON file, or from stdin if planFile is "-"
 func ReadPlan(planFile string) (*types.Plan, error) {
-	data, err := os.ReadFile(planFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read plan file: %w", err)
+	var data []byte
+	var err error
+	if planFile == StdioPlan {
+		data, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read plan from stdin: %w", err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, fmt.Errorf("failed to read plan from stdin: no input")
+		}
+	} else {
+		data, err = os.ReadFile(planFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read plan file: %w", err)
+		}
+		if isGzipPlan(planFile) {
+			if data, err = gunzip(data); err != nil {
+				return nil, fmt.Errorf("failed to decompress plan file: %w", err)
+			}
+		}
 	}
 
 	var plan types.Plan
 	if err := json.Unmarshal(data, &plan); err != nil {
+		if planFile == StdioPlan {
+			return nil, fmt.Errorf("failed to parse plan from stdin (expected JSON plan): %w", err)
+		}
 		return nil, fmt.Errorf("failed to parse plan file: %w", err)
 	}
 
+	if err := MigratePlan(&plan); err != nil {
+		return nil, err
+	}
+
 	return &plan, nil
 }
 
-// WritePlan writes a plan to a JSON file
+// WritePlan writes a plan to a JSON file, or to stdout if planFile is "-"
 func WritePlan(planFile string, plan *types.Plan) error {
-	data, err := json.MarshalIndent(plan, "", "  ")
+	return writePlan(planFile, plan, false)
+}
+
+// WritePlanCompact writes a plan like WritePlan, as single-line JSON
+func WritePlanCompact(planFile string, plan *types.Plan) error {
+	return writePlan(planFile, plan, true)
+}
+
+func writePlan(planFile string, plan *types.Plan, compact bool) error {
+	var data []byte
+	var err error
+	if compact {
+		data, err = json.Marshal(plan)
+	} else {
+		data, err = json.MarshalIndent(plan, "", "  ")
+	}
 	if err != nil {
 		return fmt.Errorf("failed to marshal plan: %w", err)
 	}
 
+	if planFile == StdioPlan {
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to write plan to stdout: %w", err)
+		}
+		return nil
+	}
+
+	if isGzipPlan(planFile) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return fmt.Errorf("failed to compress plan: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress plan: %w", err)
+		}
+		data = buf.Bytes()
+	}
+
 	if err := os.WriteFile(planFile, data, 0644); err != nil {
 		return fmt.Errorf("failed to write plan file: %w", err)
 	}
@@ -53,55 +130,431 @@ func WritePlan(planFile string, plan *types.Plan) error {
 	return nil
 }
 
-// Apply executes a plan
-func (a *Applier) Apply(plan *types.Plan, opts types.ApplyOptions) error {
+// gunzip decompresses gzip data
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// PrintPlan prints a preview of the plan's links
+func PrintPlan(plan *types.Plan) {
+	fmt.Println("[INFO] Plan preview:")
+	if plan.Comment != "" {
+		fmt.Printf("  # %s\n", plan.Comment)
+	}
+	for _, link := range plan.Links {
+		fmt.Printf("  %s -> %s (%s)\n", link.Target, link.Source, link.Reason)
+	}
+}
+
+// Apply executes a plan. If opts.Report is set, a JSON record of the
+// run is written there once it finishes, even when the apply fails.
+func (a *Applier) Apply(plan *types.Plan, opts types.ApplyOptions) (err error) {
+	result := newApplyResult(opts)
+	a.lastResult = result
+
+	if opts.Report != "" {
+		defer func() { a.finishReport(opts.Report, result, err) }()
+	}
+
 	fmt.Printf("[INFO] Applying execution plan...\n")
+	release, err := beginApply(plan, opts)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gates := newPlanGates(plan.Hooks)
+	for _, link := range plan.Links {
+		gates.add(link)
+	}
+	confirmed, err := gates.confirm(opts)
+	if err != nil {
+		return err
+	}
+
+	// Summary-and-prompt gate before any change is made
+	if opts.Confirm && !opts.Yes {
+		var candidates []types.Link
+		for _, link := range plan.Links {
+			if !link.RequireConfirm || confirmed {
+				candidates = append(candidates, link)
+			}
+		}
+		if opts.DryRun {
+			printSummary(candidates)
+		} else if !confirmSummary(candidates) {
+			return fmt.Errorf("apply aborted: not confirmed")
+		}
+	}
+
+	if err := a.runPreApply(gates.preApplyHooks(confirmed), opts); err != nil {
+		return err
+	}
+
+	// Remove links whose target moved for the same source since the last
+	// applied plan, once their new targets are linked
+	prev := loadPreviousPlan()
+	run := newApplyRun(result, len(plan.Links), prev, gates.changes.empty())
+	moves := confirmedMoves(prev, plan.Links, confirmed)
+	a.applyLinks(plan.Links, confirmed, opts, run)
+	result.Errors = append(result.Errors, a.applyMoves(moves, opts, run)...)
+
+	// Run postApply hooks of directories whose links were changed
+	a.runPostApply(run.changed.hooks(), opts, result)
+
+	run.printSummary()
+
+	// Remember what was applied so the next apply can detect moved targets
+	if run.savesPlan(opts) {
+		if err := saveLastPlan(plan); err != nil {
+			fmt.Printf("[WARN] Failed to save applied plan: %s\n", err)
+		}
+	}
+
+	return run.err()
+}
+
+// finishReport writes the report of a finished apply, recording the error
+// it ended with
+func (a *Applier) finishReport(reportFile string, result *types.ApplyResult, err error) {
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	result.FinishedAt = time.Now()
+	if werr := WriteReport(reportFile, result); werr != nil {
+		fmt.Printf("[ERROR] %s\n", werr)
+	} else if a.verbose {
+		fmt.Printf("[INFO] Report written: %s\n", reportFile)
+	}
+}
 
+// checkRequirements reports unmet plan requirements. They are only
+// warnings in dry-run mode; otherwise the apply is refused.
+func checkRequirements(req *types.Requirements, opts types.ApplyOptions) error {
+	unmet := unmetRequirements(req, opts)
+	if len(unmet) == 0 {
+		return nil
+	}
 	if opts.DryRun {
-		fmt.Printf("[WARN] DRY-RUN MODE: No changes will be made\n")
+		for _, u := range unmet {
+			fmt.Printf("[WARN] Requirement not met: %s\n", u)
+		}
+		return nil
+	}
+	for _, u := range unmet {
+		fmt.Printf("[ERROR] Requirement not met: %s\n", u)
 	}
+	return fmt.Errorf("%d plan requirements not met", len(unmet))
+}
 
-	var count, success, skipped int
+// applyRun accumulates the outcome of applying links, possibly in chunks
+type applyRun struct {
+	result       *types.ApplyResult
+	total        int // Links in the plan, for [n/total] numbering
+	count        int
+	success      int
+	skipped      int
+	violations   int
+	dirConflicts int
+	mismatches   int
+	changed      *hookTracker    // Hooks of directories whose links were changed, for postApply
+	written      map[string]bool // Copy and hardlink targets of the last applied plan
+	linked       map[string]bool // Targets whose link is in place after this run
+	failures     []string
+	stopped      bool // Stopped at the first failed link without --keep-going
+}
 
-	for _, link := range plan.Links {
-		count++
+// newApplyRun starts a run over total links of a plan. prev is the last
+// applied plan; hooks tracks the plan's hooks, none triggered.
+func newApplyRun(result *types.ApplyResult, total int, prev *types.Plan, hooks *hookTracker) *applyRun {
+	return &applyRun{
+		result:  result,
+		total:   total,
+		changed: hooks,
+		written: writtenTargets(prev),
+		linked:  make(map[string]bool),
+	}
+}
+
+// savesPlan reports whether the applied plan becomes the last applied
+// plan: only real runs without failed links are remembered
+func (run *applyRun) savesPlan(opts types.ApplyOptions) bool {
+	return !opts.DryRun && len(run.failures) == 0
+}
+
+// applyLinks applies links in order, recording each outcome in run.
+// Links from sources that require confirmation are skipped unless confirmed.
+func (a *Applier) applyLinks(links []types.Link, confirmed bool, opts types.ApplyOptions, run *applyRun) {
+	for _, link := range links {
+		if run.stopped {
+			return
+		}
+		run.count++
+		prefix := fmt.Sprintf("[%d/%d] ", run.count, run.total)
+
+		linkResult := types.LinkResult{
+			Source:  link.Source,
+			Target:  link.Target,
+			Action:  link.Action,
+			Outcome: types.OutcomeSkipped,
+		}
+
+		if link.RequireConfirm && !confirmed {
+			fmt.Printf("%s[SKIP] Not confirmed: %s\n", prefix, link.Target)
+			run.skipped++
+			linkResult.Error = "not confirmed"
+			run.result.Links = append(run.result.Links, linkResult)
+			continue
+		}
 
 		if a.verbose {
-			fmt.Printf("[%d] %s <- %s (%s)\n", count, link.Target, link.Source, link.Reason)
+			fmt.Printf("%s%s <- %s (%s)\n", prefix, link.Target, link.Source, link.Reason)
 		}
 
 		// Check if source exists
 		if _, err := os.Stat(link.Source); os.IsNotExist(err) {
-			fmt.Printf("[WARN] Source file not found, skipping: %s\n", link.Source)
-			skipped++
+			run.skipped++
+			if !opts.FailMissing {
+				fmt.Printf("%s[WARN] Source file not found, skipping: %s\n", prefix, link.Source)
+				linkResult.Error = "source not found"
+				run.result.Links = append(run.result.Links, linkResult)
+				continue
+			}
+			fmt.Printf("%s[ERROR] Source file not found: %s\n", prefix, link.Source)
+			run.failures = append(run.failures, fmt.Sprintf("%s: source not found: %s", link.Target, link.Source))
+			linkResult.Outcome = types.OutcomeFailed
+			linkResult.Error = "source not found"
+			run.result.Links = append(run.result.Links, linkResult)
+			if !opts.KeepGoing {
+				run.stopped = true
+				return
+			}
 			continue
 		}
 
+		predicted := ClassifyLink(link)
+		changed := predicted != OpUnchanged
+		var before targetState
+		if opts.VerifyDryRun {
+			before = snapshotTarget(link.Target)
+		}
+
+		linkOpts := opts
+		linkOpts.LogPrefix = prefix
+		if link.DirMode != "" {
+			linkOpts.DirMode = link.DirMode
+		}
+		switch link.Backup {
+		case types.BackupAlways:
+			linkOpts.Backup = true
+		case types.BackupNever:
+			linkOpts.Backup = false
+		}
+
+		if _, err := os.Lstat(link.Target); err == nil {
+			linkResult.Replaced = true
+		}
+		// Remember the content of a real file about to be replaced, unless
+		// CDM wrote it itself
+		if changed && !opts.DryRun && !run.written[link.Target] {
+			linkResult.ReplacedSHA256, _ = hashRealFile(link.Target)
+		}
+
+		start := time.Now()
 		var err error
 		switch link.Action {
 		case "copy":
-			err = a.sm.CopyFile(link.Target, link.Source, opts)
-		default: // "link"
-			err = a.sm.CreateSymlink(link.Target, link.Source, opts)
+			err = a.sm.CopyFile(link.Target, link.Source, linkOpts)
+		case "hardlink":
+			err = a.sm.CreateHardlink(link.Target, link.Source, linkOpts)
+		case "mkdir":
+			err = a.sm.CreateDir(link.Target, linkOpts)
+		case "link":
+			err = a.sm.CreateSymlink(link.Target, link.Source, linkOpts)
+		default:
+			err = fmt.Errorf("unknown action %q; regenerate the plan with 'cdm plan'", link.Action)
 		}
+		linkResult.Duration = time.Since(start)
+		linkResult.Backup = a.sm.BackupFor(link.Target)
 
 		if err != nil {
-			fmt.Printf("[ERROR] Failed to %s: %s\n", link.Action, err)
-			skipped++
+			fmt.Printf("%s[ERROR] Failed to %s: %s\n", prefix, link.Action, err)
+			if errors.Is(err, fs.ErrFrozen) {
+				run.violations++
+			}
+			if errors.Is(err, fs.ErrTargetIsDir) {
+				run.dirConflicts++
+			}
+			run.skipped++
+			run.failures = append(run.failures, fmt.Sprintf("%s: %s", link.Target, err))
+			linkResult.Outcome = types.OutcomeFailed
+			linkResult.Error = err.Error()
+			run.result.Links = append(run.result.Links, linkResult)
+			if !opts.KeepGoing {
+				run.stopped = true
+				return
+			}
 			continue
 		}
 
-		success++
+		// Mode enforcement below is not part of the classification
+		if opts.VerifyDryRun && !opts.DryRun {
+			if problem := verifyPrediction(link, predicted, before); problem != "" {
+				fmt.Printf("%s[MISMATCH] %s: %s\n", prefix, link.Target, problem)
+				run.result.Errors = append(run.result.Errors, fmt.Sprintf("%s: %s", link.Target, problem))
+				run.mismatches++
+			}
+		}
+
+		// Enforce configured permissions on the file that holds the content
+		if link.Mode != "" {
+			modePath := link.Source
+			if link.Action == "copy" || link.Action == "mkdir" {
+				modePath = link.Target
+			}
+			modeChanged, err := a.sm.EnsureMode(modePath, link.Mode, linkOpts)
+			if err != nil {
+				fmt.Printf("%s[ERROR] %s\n", prefix, err)
+				run.result.Errors = append(run.result.Errors, err.Error())
+			}
+			changed = changed || modeChanged
+		}
+
+		// Set configured extended attributes on the target itself
+		if opts.SetXattrs && len(link.Xattrs) > 0 {
+			xattrChanged, err := a.sm.EnsureXattrs(link.Target, link.Xattrs, linkOpts)
+			if err != nil {
+				fmt.Printf("%s[ERROR] %s\n", prefix, err)
+				run.result.Errors = append(run.result.Errors, err.Error())
+			}
+			changed = changed || xattrChanged
+		}
+
+		run.success++
+		run.linked[link.Target] = true
+		if changed {
+			run.changed.add(link)
+			linkResult.Outcome = types.OutcomeApplied
+			if linkResult.ReplacedSHA256 != "" {
+				ow := types.Overwrite{
+					Time:   time.Now(),
+					Target: link.Target,
+					Source: link.Source,
+					SHA256: linkResult.ReplacedSHA256,
+					Backup: linkResult.Backup,
+				}
+				if err := recordOverwrite(ow); err != nil {
+					fmt.Printf("%s[WARN] Failed to record overwritten file: %s\n", prefix, err)
+				}
+			}
+		} else {
+			linkResult.Outcome = types.OutcomeUnchanged
+		}
+		run.result.Links = append(run.result.Links, linkResult)
+	}
+
+}
+
+// printSummary prints the totals of a run, including the links of the plan
+// not attempted after a stop
+func (run *applyRun) printSummary() {
+	run.result.Total = run.count
+	run.result.Success = run.success
+	run.result.Skipped = run.skipped
+
+	switch {
+	case run.stopped:
+		fmt.Printf("[ERROR] Apply stopped at the first failed link (use --keep-going to continue past failures)\n")
+	case len(run.failures) > 0:
+		fmt.Printf("[ERROR] Apply completed with %d failed links\n", len(run.failures))
+	default:
+		fmt.Printf("[SUCCESS] Apply completed\n")
+	}
+	fmt.Printf("  Total: %d\n", run.count)
+	fmt.Printf("  Success: %d\n", run.success)
+	fmt.Printf("  Skipped: %d\n", run.skipped)
+	if run.stopped {
+		fmt.Printf("  Not attempted: %d\n", run.total-run.count)
+	}
+
+	if run.dirConflicts > 0 {
+		fmt.Printf("[WARN] %d targets are blocked by existing directories; rerun with --force to move them aside\n", run.dirConflicts)
+	}
+}
+
+// err returns the error a run ends with: failed links, or dry-run
+// predictions that disagreed with apply
+func (run *applyRun) err() error {
+	if len(run.failures) > 0 {
+		msg := fmt.Sprintf("%d links failed", len(run.failures))
+		if run.violations > 0 {
+			msg = fmt.Sprintf("frozen mode: %d existing targets would have been replaced; %s", run.violations, msg)
+		}
+		return fmt.Errorf("%s:\n  %s", msg, strings.Join(run.failures, "\n  "))
+	}
+	if run.mismatches > 0 {
+		return fmt.Errorf("dry-run classification disagreed with apply for %d links", run.mismatches)
+	}
+	return nil
+}
+
+// WriteReport writes an apply result as JSON
+func WriteReport(reportFile string, result *types.ApplyResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal apply report: %w", err)
 	}
 
-	fmt.Printf("[SUCCESS] Apply completed\n")
-	fmt.Printf("  Total: %d\n", count)
-	fmt.Printf("  Success: %d\n", success)
-	fmt.Printf("  Skipped: %d\n", skipped)
+	if err := os.WriteFile(reportFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write apply report: %w", err)
+	}
 
 	return nil
 }
 
+// confirmLinks lists links that require confirmation and prompts the user.
+// Returns true only if the user explicitly answers yes.
+func confirmLinks(links []types.Link) bool {
+	fmt.Printf("[WARN] %d links come from sources that require confirmation:\n", len(links))
+	for _, link := range links {
+		fmt.Printf("  %s -> %s\n", link.Target, link.Source)
+	}
+	return promptYesNo("Apply these links?")
+}
+
+// confirmSystemLinks lists links that would change system paths and
+// prompts the user. Returns true only if the user explicitly answers yes.
+func confirmSystemLinks(links []types.Link) bool {
+	fmt.Printf("[WARN] %d links would change system paths:\n", len(links))
+	for _, link := range links {
+		fmt.Printf("  %s -> %s\n", link.Target, link.Source)
+	}
+	return promptYesNo("Change system paths?")
+}
+
+// stdinReader is shared by prompts so buffered input isn't lost between them
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// promptYesNo asks a y/N question on stdin. Returns true only if the user
+// explicitly answers yes.
+func promptYesNo(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	answer, err := stdinReader.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 // ApplyFromFile reads and applies a plan from a file
 func (a *Applier) ApplyFromFile(planFile string, opts types.ApplyOptions) error {
 	plan, err := ReadPlan(planFile)
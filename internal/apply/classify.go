@@ -0,0 +1,150 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/internal/tree"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// LinkOp classifies what applying a link would do to its target
+type LinkOp string
+
+const (
+	OpCreate    LinkOp = "create"    // Target does not exist
+	OpUnchanged LinkOp = "unchanged" // Target is already correct
+	OpRemove    LinkOp = "remove"    // An existing symlink is removed and recreated
+	OpOverwrite LinkOp = "overwrite" // An existing file or directory is replaced
+	OpConflict  LinkOp = "conflict"  // An existing target is never replaced; applying fails
+)
+
+// IsDestructive reports whether the operation can lose existing data
+// or links not managed by this plan
+func (op LinkOp) IsDestructive() bool {
+	return op == OpRemove || op == OpOverwrite
+}
+
+// ClassifyLink decides which operation applying a link would perform
+func ClassifyLink(link types.Link) LinkOp {
+	info, err := os.Lstat(link.Target)
+	if err != nil {
+		return OpCreate
+	}
+
+	// Like CreateDir, follow symlinks and refuse to replace non-directories
+	if link.Action == "mkdir" {
+		if info, err := os.Stat(link.Target); err == nil && info.IsDir() {
+			return OpUnchanged
+		}
+		return OpConflict
+	}
+
+	if link.Action == "copy" {
+		if match, err := fs.FileContentsMatch(link.Source, link.Target); err == nil && match {
+			return OpUnchanged
+		}
+		return OpOverwrite
+	}
+
+	// A symlink to the source is what --hardlink replaces, not a hard link
+	if link.Action == "hardlink" {
+		if fs.IsSameFile(link.Target, link.Source) {
+			return OpUnchanged
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return OpRemove
+		}
+		return OpOverwrite
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if fs.IsCorrectSymlink(link.Target, link.Source) {
+			return OpUnchanged
+		}
+		return OpRemove
+	}
+	return OpOverwrite
+}
+
+// linkNeedsChange reports whether applying a link would modify the target
+func linkNeedsChange(link types.Link) bool {
+	op := ClassifyLink(link)
+	return op != OpUnchanged && op != OpConflict
+}
+
+// printSummary prints counts per operation and the destructive operations.
+// Returns the number of links that would change.
+func printSummary(links []types.Link) int {
+	counts := make(map[LinkOp]int)
+	var destructive, conflicts []string
+	for _, link := range links {
+		op := ClassifyLink(link)
+		counts[op]++
+		if op.IsDestructive() {
+			destructive = append(destructive, fmt.Sprintf("  %-9s %s", op, link.Target))
+		}
+		if op == OpConflict {
+			conflicts = append(conflicts, "  "+link.Target)
+		}
+	}
+
+	fmt.Printf("[INFO] Summary: %d create, %d overwrite, %d remove, %d unchanged\n",
+		counts[OpCreate], counts[OpOverwrite], counts[OpRemove], counts[OpUnchanged])
+	if len(destructive) > 0 {
+		fmt.Printf("[WARN] Destructive operations:\n")
+		for _, line := range destructive {
+			fmt.Println(line)
+		}
+	}
+	if len(conflicts) > 0 {
+		fmt.Printf("[WARN] Existing targets that will not be replaced (these links will fail):\n")
+		for _, line := range conflicts {
+			fmt.Println(line)
+		}
+	}
+
+	return counts[OpCreate] + counts[OpOverwrite] + counts[OpRemove]
+}
+
+// PrintPreviewTree prints the targets of a plan as a tree, annotated with
+// each link's action and the operation applying it would perform, followed
+// by the operation summary. Nothing is changed on disk.
+func PrintPreviewTree(plan *types.Plan, opts types.ApplyOptions) {
+	tree.PrintTreeWith(plan, func(link types.Link) string {
+		action := link.Action
+		if action == "" {
+			action = "link"
+		}
+		op := ClassifyLink(link)
+		label := fmt.Sprintf("[%s, %s] <- %s", action, op, link.Source)
+		if op == OpOverwrite && linkBackedUp(link, opts) {
+			label += " (backup)"
+		}
+		return label
+	})
+	fmt.Println()
+	printSummary(plan.Links)
+}
+
+// linkBackedUp reports whether an overwritten target would be backed up,
+// honoring per-link backup overrides
+func linkBackedUp(link types.Link, opts types.ApplyOptions) bool {
+	switch link.Backup {
+	case types.BackupAlways:
+		return true
+	case types.BackupNever:
+		return false
+	}
+	return opts.Backup
+}
+
+// confirmSummary prints the operation summary and prompts. Returns true
+// if the user confirms or if there is nothing to change.
+func confirmSummary(links []types.Link) bool {
+	if printSummary(links) == 0 {
+		return true
+	}
+	return promptYesNo("Proceed?")
+}
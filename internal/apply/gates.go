@@ -0,0 +1,146 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// newApplyResult starts the result record of an apply
+func newApplyResult(opts types.ApplyOptions) *types.ApplyResult {
+	result := &types.ApplyResult{
+		StartedAt: time.Now(),
+		DryRun:    opts.DryRun,
+	}
+	result.Hostname, _ = os.Hostname()
+	return result
+}
+
+// beginApply prints the plan's comment and the dry-run notice, refuses the
+// plan if the system lacks what it needs, and takes the apply lock so that
+// concurrent applies do not race on the same targets. The returned func
+// releases the lock.
+func beginApply(plan *types.Plan, opts types.ApplyOptions) (func(), error) {
+	if plan.Comment != "" {
+		fmt.Printf("[INFO] Plan comment: %s\n", plan.Comment)
+	}
+	if opts.DryRun {
+		fmt.Printf("[WARN] DRY-RUN MODE: No changes will be made\n")
+	}
+
+	if err := checkRequirements(plan.Requirements, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.DryRun || opts.NoLock {
+		return func() {}, nil
+	}
+	lock, err := acquireLock()
+	if err != nil {
+		return nil, err
+	}
+	return lock.release, nil
+}
+
+// planGates collects what has to be confirmed, and which preApply hooks
+// have to run, before an apply changes anything. Links are added one at a
+// time, so streamed plans need not be held in memory.
+type planGates struct {
+	pending     []types.Link // Links from sources that require confirmation
+	system      []types.Link // Changed links under system paths
+	changes     *hookTracker // Hooks triggered by changed links
+	unconfirmed *hookTracker // Hooks triggered by changed links that require confirmation
+}
+
+func newPlanGates(hooks []types.HookSet) *planGates {
+	changes := newHookTracker(hooks)
+	return &planGates{changes: changes, unconfirmed: changes.empty()}
+}
+
+// add records a link of the plan
+func (g *planGates) add(link types.Link) {
+	if link.RequireConfirm {
+		g.pending = append(g.pending, link)
+	}
+	if !linkNeedsChange(link) {
+		return
+	}
+	if fs.NeedsSudo(link.Target) {
+		g.system = append(g.system, link)
+	}
+	if link.RequireConfirm {
+		g.unconfirmed.add(link)
+	} else {
+		g.changes.add(link)
+	}
+}
+
+// confirm asks for the links from requireConfirm sources, then for changes
+// to system paths, which can break the machine and need their own explicit
+// consent. Returns whether the requireConfirm links were confirmed; refusing
+// the system paths aborts the apply.
+func (g *planGates) confirm(opts types.ApplyOptions) (bool, error) {
+	confirmed := opts.Yes || opts.DryRun
+	if !confirmed && len(g.pending) > 0 {
+		confirmed = confirmLinks(g.pending)
+	}
+
+	var system []types.Link
+	for _, link := range g.system {
+		if !link.RequireConfirm || confirmed {
+			system = append(system, link)
+		}
+	}
+	if err := confirmSystem("apply", system, opts); err != nil {
+		return false, err
+	}
+	return confirmed, nil
+}
+
+// confirmSystem asks before an operation changes system paths, unless it is
+// a dry run or --yes-i-understand-root was given. Refusing aborts the
+// operation.
+func confirmSystem(op string, links []types.Link, opts types.ApplyOptions) error {
+	if opts.DryRun || opts.AllowSystem || len(links) == 0 {
+		return nil
+	}
+	if !confirmSystemLinks(links) {
+		return fmt.Errorf("%s aborted: changes to system paths not confirmed (use --yes-i-understand-root)", op)
+	}
+	return nil
+}
+
+// preApplyHooks returns the hooks of directories with pending changes,
+// counting links that require confirmation only if they were confirmed
+func (g *planGates) preApplyHooks(confirmed bool) []types.HookSet {
+	if confirmed {
+		g.changes.merge(g.unconfirmed)
+	}
+	return g.changes.hooks()
+}
+
+// loadPreviousPlan reads the last applied plan, which moved links and the
+// overwrite log are judged against. An unreadable plan is ignored.
+func loadPreviousPlan() *types.Plan {
+	prev, err := LoadLastPlan()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] Ignoring last applied plan: %s\n", err)
+	}
+	return prev
+}
+
+// confirmedMoves returns the links whose target moved since prev, leaving
+// out sources whose links were not confirmed
+func confirmedMoves(prev *types.Plan, links []types.Link, confirmed bool) []linkMove {
+	var moves []linkMove
+	for _, m := range detectMoves(prev, &types.Plan{Links: links}) {
+		if !confirmed && unconfirmedSource(links, m.Source) {
+			continue
+		}
+		moves = append(moves, m)
+	}
+	return moves
+}
@@ -0,0 +1,199 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/internal/plan"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// hookOwnsLink reports whether a link's source lies within a hook's directory
+func hookOwnsLink(hook types.HookSet, link types.Link) bool {
+	return link.Source == hook.Dir ||
+		strings.HasPrefix(link.Source, hook.Dir+string(filepath.Separator))
+}
+
+// hookScope decides which changed links trigger a hook: links from the
+// hook's directory, further restricted by its when globs if it has any
+type hookScope struct {
+	hook types.HookSet
+	when []plan.TargetPattern
+}
+
+// newHookScope compiles a hook's when globs. Plans are validated when they
+// are generated; a hook with a broken glob is never triggered.
+func newHookScope(hook types.HookSet) (hookScope, bool) {
+	when, err := plan.CompileTargetPatterns(hook.When)
+	if err != nil {
+		fmt.Printf("[WARN] Ignoring hooks in %s: invalid when glob: %s\n", hook.Dir, err)
+		return hookScope{}, false
+	}
+	return hookScope{hook: hook, when: when}, true
+}
+
+// triggeredBy reports whether a changed link triggers the hook
+func (s hookScope) triggeredBy(link types.Link) bool {
+	if !hookOwnsLink(s.hook, link) {
+		return false
+	}
+	return len(s.when) == 0 || plan.MatchTarget(s.when, link.Target)
+}
+
+// hookTracker records which hooks of a plan are triggered by the changed
+// links passed to add. Links can be added in chunks as a plan streams by.
+type hookTracker struct {
+	scopes    []*hookScope // nil for hooks with broken when globs
+	triggered []bool
+}
+
+func newHookTracker(hooks []types.HookSet) *hookTracker {
+	t := &hookTracker{scopes: make([]*hookScope, len(hooks)), triggered: make([]bool, len(hooks))}
+	for i, hook := range hooks {
+		if scope, ok := newHookScope(hook); ok {
+			t.scopes[i] = &scope
+		}
+	}
+	return t
+}
+
+// empty returns a tracker over the same hooks with none triggered
+func (t *hookTracker) empty() *hookTracker {
+	return &hookTracker{scopes: t.scopes, triggered: make([]bool, len(t.scopes))}
+}
+
+// add marks the hooks triggered by a changed link
+func (t *hookTracker) add(link types.Link) {
+	for i, scope := range t.scopes {
+		if scope != nil && !t.triggered[i] && scope.triggeredBy(link) {
+			t.triggered[i] = true
+		}
+	}
+}
+
+// merge marks the hooks triggered in other, a tracker over the same hooks
+func (t *hookTracker) merge(other *hookTracker) {
+	for i, ok := range other.triggered {
+		if ok {
+			t.triggered[i] = true
+		}
+	}
+}
+
+// hooks returns the triggered hooks in plan order
+func (t *hookTracker) hooks() []types.HookSet {
+	var result []types.HookSet
+	for i, scope := range t.scopes {
+		if t.triggered[i] {
+			result = append(result, scope.hook)
+		}
+	}
+	return result
+}
+
+// runPreApply runs the preApply hooks; the first failure aborts the apply
+func (a *Applier) runPreApply(hooks []types.HookSet, opts types.ApplyOptions) error {
+	for _, hook := range hooks {
+		if err := a.runHook("preApply", hook.Dir, hook.PreApply, opts.DryRun, opts.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPostApply runs the postApply hooks, recording failures in result
+func (a *Applier) runPostApply(hooks []types.HookSet, opts types.ApplyOptions, result *types.ApplyResult) {
+	for _, hook := range hooks {
+		if err := a.runHook("postApply", hook.Dir, hook.PostApply, opts.DryRun, opts.Timeout); err != nil {
+			fmt.Printf("[ERROR] %s\n", err)
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+}
+
+// validateHookCommand checks that the first command of a hook can be found,
+// either on PATH or, for paths, relative to the hook directory
+func validateHookCommand(dir, command string) error {
+	name := plan.HookCommand(dir, command)
+	if name == "" {
+		return nil
+	}
+	return findCommand(name)
+}
+
+// findCommand checks that a command name is on PATH, or that a path is an
+// executable file
+func findCommand(name string) error {
+	if strings.Contains(name, "/") {
+		info, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("command not found: %s", name)
+		}
+		if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+			return fmt.Errorf("command is not executable: %s", name)
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("command not found: %s", name)
+	}
+	return nil
+}
+
+// unmetRequirements returns a description of each plan requirement this
+// system does not satisfy
+func unmetRequirements(req *types.Requirements, opts types.ApplyOptions) []string {
+	if req == nil {
+		return nil
+	}
+
+	var unmet []string
+	for _, name := range req.Commands {
+		if err := findCommand(name); err != nil {
+			unmet = append(unmet, err.Error())
+		}
+	}
+
+	if req.Sudo && !fs.IsRoot() {
+		switch opts.PrivilegeTool {
+		case fs.PrivilegeNone:
+			unmet = append(unmet, "targets in system directories need privileges, but privilege escalation is disabled")
+		default:
+			tool := opts.PrivilegeTool
+			if tool == "" {
+				tool = fs.PrivilegeSudo
+			}
+			if _, err := exec.LookPath(tool); err != nil {
+				unmet = append(unmet, fmt.Sprintf("targets in system directories need %s, which is not installed", tool))
+			}
+		}
+	}
+	return unmet
+}
+
+// runHook runs a hook command through the shell inside the hook directory
+func (a *Applier) runHook(stage, dir, command string, dryRun bool, timeout time.Duration) error {
+	if command == "" {
+		return nil
+	}
+
+	if dryRun {
+		fmt.Printf("[DRY-RUN] Would run %s hook in %s: %s\n", stage, dir, command)
+		if err := validateHookCommand(dir, command); err != nil {
+			fmt.Printf("[WARN] %s hook in %s: %s\n", stage, dir, err)
+		}
+		return nil
+	}
+
+	fmt.Printf("[HOOK] %s (%s): %s\n", stage, dir, command)
+	if err := fs.RunCommand(dir, timeout, "sh", "-c", command); err != nil {
+		return fmt.Errorf("%s hook in %s failed: %w", stage, dir, err)
+	}
+	return nil
+}
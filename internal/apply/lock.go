@@ -0,0 +1,32 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/woodgear/cdm/internal/config"
+)
+
+// LockFileName is the name of the apply lock file inside the state dir
+const LockFileName = "apply.lock"
+
+// applyLock is an exclusive lock held for the duration of an apply
+type applyLock struct {
+	file *os.File
+	path string
+}
+
+// lockPath returns the path of the apply lock file, creating the state dir
+func lockPath() (string, error) {
+	stateDir, err := config.EnsureStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, LockFileName), nil
+}
+
+// lockHeldError reports that another apply holds the lock
+func lockHeldError(path string) error {
+	return fmt.Errorf("another cdm apply is already running (lock held on %s); use --no-lock to bypass", path)
+}
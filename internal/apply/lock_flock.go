@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package apply
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// acquireLock takes the exclusive apply lock without blocking.
+// Fails immediately if another apply currently holds it.
+func acquireLock() (*applyLock, error) {
+	path, err := lockPath()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, lockHeldError(path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	return &applyLock{file: f, path: path}, nil
+}
+
+// release drops the lock and closes the lock file
+func (l *applyLock) release() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
@@ -0,0 +1,36 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package apply
+
+import (
+	"fmt"
+	"os"
+)
+
+// acquireLock takes the exclusive apply lock without blocking.
+// Fails immediately if another apply currently holds it.
+//
+// Without flock the lock is the existence of the lock file, so a crashed
+// apply leaves it behind; remove it or use --no-lock in that case.
+func acquireLock() (*applyLock, error) {
+	path, err := lockPath()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, lockHeldError(path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	return &applyLock{file: f, path: path}, nil
+}
+
+// release closes and removes the lock file
+func (l *applyLock) release() {
+	l.file.Close()
+	os.Remove(l.path)
+}
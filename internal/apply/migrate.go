@@ -0,0 +1,76 @@
+package apply
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// planMigration upgrades a plan from one minor version to the next
+type planMigration struct {
+	from    int // Minor version this migration applies to
+	migrate func(plan *types.Plan)
+}
+
+// planMigrations lists migrations in order, keyed by source minor version
+var planMigrations = []planMigration{
+	// 1.0 -> 1.1: action became mandatory; hooks and requireConfirm added
+	{from: 0, migrate: func(plan *types.Plan) {
+		for i := range plan.Links {
+			if plan.Links[i].Action == "" {
+				plan.Links[i].Action = "link"
+			}
+		}
+	}},
+	// 1.1 -> 1.2: hardlink and mkdir actions added; existing plans need no changes
+	{from: 1, migrate: func(plan *types.Plan) {}},
+}
+
+// parseVersion parses a "major.minor[.patch]" version string
+func parseVersion(version string) (major, minor int, err error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("invalid version %q", version)
+	}
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid version %q", version)
+	}
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("invalid version %q", version)
+	}
+	return major, minor, nil
+}
+
+// MigratePlan validates a plan's version and upgrades older plans to the
+// current format, filling in defaults. Incompatible plans are rejected.
+func MigratePlan(plan *types.Plan) error {
+	version := plan.Version
+	if version == "" {
+		// Plans written before versioning was enforced
+		version = "1.0.0"
+	}
+
+	major, minor, err := parseVersion(version)
+	if err != nil {
+		return fmt.Errorf("unsupported plan: %w", err)
+	}
+	curMajor, curMinor, _ := parseVersion(types.PlanVersion)
+
+	if major != curMajor {
+		return fmt.Errorf("incompatible plan version %s (supported: %d.x); regenerate it with 'cdm plan'", version, curMajor)
+	}
+	if minor > curMinor {
+		return fmt.Errorf("plan version %s is newer than supported %s; upgrade cdm or regenerate the plan", version, types.PlanVersion)
+	}
+
+	for _, m := range planMigrations {
+		if m.from >= minor {
+			m.migrate(plan)
+		}
+	}
+
+	plan.Version = types.PlanVersion
+	return nil
+}
@@ -0,0 +1,136 @@
+package apply
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/woodgear/cdm/internal/config"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// OverwritesFileName is the log of real files replaced by applies inside
+// the state dir, one JSON record per line
+const OverwritesFileName = "overwrites.jsonl"
+
+// overwritesPath returns the path of the overwrite log
+func overwritesPath() (string, error) {
+	stateDir, err := config.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, OverwritesFileName), nil
+}
+
+// hashRealFile returns the SHA-256 of path if it is a regular file, which
+// is not a link CDM made and would be lost when the target is replaced
+func hashRealFile(path string) (string, bool) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", false
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// writtenTargets returns the targets the last applied plan copied or
+// hardlinked. They hold content CDM wrote, so replacing them loses nothing.
+func writtenTargets(prev *types.Plan) map[string]bool {
+	written := make(map[string]bool)
+	if prev == nil {
+		return written
+	}
+	for _, link := range prev.Links {
+		if link.Action == "copy" || link.Action == "hardlink" {
+			written[link.Target] = true
+		}
+	}
+	return written
+}
+
+// recordOverwrite appends a replaced real file to the overwrite log
+func recordOverwrite(ow types.Overwrite) error {
+	path, err := overwritesPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	data, err := json.Marshal(ow)
+	if err != nil {
+		return fmt.Errorf("failed to marshal overwrite: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadOverwrites reads every real file replaced by past applies, oldest
+// first. Returns nil without error if none was recorded.
+func LoadOverwrites() ([]types.Overwrite, error) {
+	path, err := overwritesPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var overwrites []types.Overwrite
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var ow types.Overwrite
+		if err := json.Unmarshal(scanner.Bytes(), &ow); err != nil {
+			return nil, fmt.Errorf("failed to parse %s line %d: %w", path, line, err)
+		}
+		overwrites = append(overwrites, ow)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return overwrites, nil
+}
+
+// PrintOverwrites prints recorded overwrites as tab-separated lines: time,
+// target, SHA-256 of the replaced content and the backup ("-" if none)
+func PrintOverwrites(overwrites []types.Overwrite) {
+	for _, ow := range overwrites {
+		backup := "-"
+		if ow.Backup != "" {
+			backup = ow.Backup
+			if _, err := os.Lstat(ow.Backup); err != nil {
+				backup += " (missing)"
+			}
+		}
+		fmt.Printf("%s\t%s\tsha256:%s\t%s\n", ow.Time.Format(time.RFC3339), ow.Target, ow.SHA256, backup)
+	}
+}
@@ -0,0 +1,110 @@
+package apply
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/woodgear/cdm/internal/config"
+)
+
+// PlanFetchTimeout bounds the download of a remote plan
+const PlanFetchTimeout = 30 * time.Second
+
+// IsRemotePlan reports whether a plan argument is an http(s) URL
+func IsRemotePlan(planFile string) bool {
+	return strings.HasPrefix(planFile, "http://") || strings.HasPrefix(planFile, "https://")
+}
+
+// planCachePath returns the local copy of a remote plan, keeping the .gz
+// extension so compressed plans are still detected when read
+func planCachePath(planURL string) (string, error) {
+	cacheDir, err := config.CacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(planURL))
+	name := hex.EncodeToString(sum[:])[:16] + ".json"
+	if u, err := url.Parse(planURL); err == nil && isGzipPlan(u.Path) {
+		name += GzipPlanExt
+	}
+	return filepath.Join(cacheDir, "plans", name), nil
+}
+
+// FetchPlan downloads a remote plan into the local cache and returns the
+// cached path for ReadPlan. If wantSHA256 is set the download must match
+// it. When the server is unreachable a previously cached copy is reused.
+func FetchPlan(planURL, wantSHA256 string) (string, error) {
+	cachePath, err := planCachePath(planURL)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := download(planURL)
+	if err != nil {
+		if _, serr := os.Stat(cachePath); serr != nil {
+			return "", err
+		}
+		fmt.Printf("[WARN] %s, using cached plan %s\n", err, cachePath)
+		if wantSHA256 != "" {
+			cached, rerr := os.ReadFile(cachePath)
+			if rerr != nil {
+				return "", fmt.Errorf("failed to read cached plan: %w", rerr)
+			}
+			if err := verifySHA256(cached, wantSHA256); err != nil {
+				return "", fmt.Errorf("cached plan %s: %w", cachePath, err)
+			}
+		}
+		return cachePath, nil
+	}
+
+	if wantSHA256 != "" {
+		if err := verifySHA256(data, wantSHA256); err != nil {
+			return "", fmt.Errorf("plan %s: %w", planURL, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := os.WriteFile(cachePath, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", cachePath, err)
+	}
+	return cachePath, nil
+}
+
+// download fetches a URL's body, failing on non-2xx responses
+func download(planURL string) ([]byte, error) {
+	client := &http.Client{Timeout: PlanFetchTimeout}
+	resp, err := client.Get(planURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed to fetch plan %s: %s", planURL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan %s: %w", planURL, err)
+	}
+	return data, nil
+}
+
+// verifySHA256 compares data with an expected hex-encoded SHA-256 digest
+func verifySHA256(data []byte, want string) error {
+	sum := sha256.Sum256(data)
+	got := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(got, strings.TrimPrefix(want, "sha256:")) {
+		return fmt.Errorf("sha256 mismatch: got %s, expected %s", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package apply
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// LastResult returns the record of the most recent Apply, or nil
+func (a *Applier) LastResult() *types.ApplyResult {
+	return a.lastResult
+}
+
+// Rollback undoes the links changed by the most recent Apply: targets that
+// were backed up are restored from their backup and newly created targets
+// are removed. Targets replaced without a backup cannot be restored and
+// are reported. Hooks are not reverted.
+func (a *Applier) Rollback(opts types.ApplyOptions) error {
+	if a.lastResult == nil {
+		return nil
+	}
+
+	var reverted int
+	var failures []string
+	for _, link := range a.lastResult.Links {
+		if link.Outcome != types.OutcomeApplied {
+			continue
+		}
+
+		switch {
+		case link.Backup != "":
+			if err := a.sm.RestoreBackup(link.Target, link.Backup, opts); err != nil {
+				fmt.Printf("[ERROR] %s\n", err)
+				failures = append(failures, link.Target)
+				continue
+			}
+			fmt.Printf("[REVERT] %s (restored from %s)\n", link.Target, link.Backup)
+		case !link.Replaced:
+			if err := a.sm.RemoveSymlink(link.Target, opts); err != nil {
+				fmt.Printf("[ERROR] %s\n", err)
+				failures = append(failures, link.Target)
+				continue
+			}
+			fmt.Printf("[REVERT] %s (removed)\n", link.Target)
+		default:
+			fmt.Printf("[WARN] Cannot revert %s: it was replaced without a backup (use --backup)\n", link.Target)
+			failures = append(failures, link.Target)
+			continue
+		}
+		reverted++
+	}
+
+	fmt.Printf("[INFO] Reverted %d links\n", reverted)
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to revert %d links: %s", len(failures), strings.Join(failures, ", "))
+	}
+	return nil
+}
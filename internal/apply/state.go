@@ -0,0 +1,141 @@
+package apply
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/woodgear/cdm/internal/config"
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// LastPlanFileName is the name of the last applied plan inside the state dir
+const LastPlanFileName = "last-plan.json"
+
+// lastPlanPath returns the path of the persisted last applied plan
+func lastPlanPath() (string, error) {
+	stateDir, err := config.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, LastPlanFileName), nil
+}
+
+// LoadLastPlan reads the last successfully applied plan.
+// Returns nil without error if no plan has been applied yet.
+func LoadLastPlan() (*types.Plan, error) {
+	path, err := lastPlanPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return ReadPlan(path)
+}
+
+// saveLastPlan persists a successfully applied plan for the next apply to diff against
+func saveLastPlan(plan *types.Plan) error {
+	path, err := lastPlanPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// linkMove is a source whose target changed between two plans
+type linkMove struct {
+	Source string
+	From   string
+	To     string
+}
+
+// detectMoves finds symlinks and hard links whose target moved for the same
+// source since the previous plan. Only old targets that are still CDM-owned
+// links (symlinks to the source, or hard links of it) and that no link in
+// the new plan claims are reported.
+func detectMoves(prev, next *types.Plan) []linkMove {
+	if prev == nil {
+		return nil
+	}
+
+	claimed := make(map[string]bool, len(next.Links))
+	newTargets := make(map[string]string, len(next.Links))
+	for _, link := range next.Links {
+		claimed[fs.PathKey(link.Target)] = true
+		if link.Action != "copy" {
+			newTargets[link.Source] = link.Target
+		}
+	}
+
+	var moves []linkMove
+	for _, old := range prev.Links {
+		if old.Action == "copy" || old.Action == "mkdir" {
+			continue
+		}
+		to, ok := newTargets[old.Source]
+		if !ok || fs.SamePath(to, old.Target) || claimed[fs.PathKey(old.Target)] {
+			continue
+		}
+		if old.Action == "hardlink" {
+			if !fs.IsSameFile(old.Target, old.Source) {
+				continue
+			}
+		} else if !fs.IsOwnedSymlink(old.Target, old.Source) {
+			continue
+		}
+		moves = append(moves, linkMove{Source: old.Source, From: old.Target, To: to})
+	}
+	return moves
+}
+
+// unconfirmedSource reports whether the link for source requires confirmation
+func unconfirmedSource(links []types.Link, source string) bool {
+	for _, link := range links {
+		if link.Source == source {
+			return link.RequireConfirm
+		}
+	}
+	return false
+}
+
+// applyMoves removes the old targets of moved links once the regular link
+// loop has put the new targets in place. Old links whose new target was not
+// linked are kept, so a failed or stopped apply never loses a link.
+func (a *Applier) applyMoves(moves []linkMove, opts types.ApplyOptions, run *applyRun) []string {
+	var errs []string
+	for _, m := range moves {
+		if opts.Frozen {
+			fmt.Printf("[WARN] Frozen mode: leaving moved link in place: %s\n", m.From)
+			continue
+		}
+		if !run.linked[m.To] {
+			fmt.Printf("[WARN] Keeping moved link %s: %s was not linked\n", m.From, m.To)
+			continue
+		}
+		if opts.DryRun {
+			fmt.Printf("[DRY-RUN] Would move: %s -> %s\n", m.From, m.To)
+			continue
+		}
+		if err := a.sm.RemoveSymlink(m.From, opts); err != nil {
+			fmt.Printf("[ERROR] %s\n", err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		fmt.Printf("[MOVE] %s -> %s\n", m.From, m.To)
+	}
+	return errs
+}
@@ -0,0 +1,94 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// PrintStowReport prints the plan's links in the style of GNU Stow's
+// verbose output: grouped by package (plan source), with targets relative
+// to the stow target directory ($HOME or the root) and link destinations
+// relative to the link's directory, as stow creates them. Copies and
+// directories, which stow has no notion of, are listed as COPY and MKDIR.
+func PrintStowReport(plan *types.Plan) {
+	home, _ := os.UserHomeDir()
+	rootDir := "/"
+	if plan.Root != "" {
+		rootDir = plan.Root
+	}
+
+	byPackage := make(map[string][]types.Link)
+	for _, link := range plan.Links {
+		pkg := stowPackage(plan.Sources, link.Source)
+		byPackage[pkg] = append(byPackage[pkg], link)
+	}
+
+	// Packages in precedence order, links outside every source last
+	packages := append([]string(nil), plan.Sources...)
+	if len(byPackage[""]) > 0 {
+		packages = append(packages, "")
+	}
+
+	printed := false
+	for _, pkg := range packages {
+		links := byPackage[pkg]
+		if len(links) == 0 {
+			continue
+		}
+		sort.Slice(links, func(i, j int) bool { return links[i].Target < links[j].Target })
+
+		if printed {
+			fmt.Println()
+		}
+		printed = true
+		if pkg == "" {
+			fmt.Println("# (external)")
+		} else {
+			fmt.Printf("# package %s (%s)\n", filepath.Base(pkg), pkg)
+		}
+
+		for _, link := range links {
+			stowDir := rootDir
+			if home != "" && strings.HasPrefix(link.Target, home+string(filepath.Separator)) {
+				stowDir = home
+			}
+			target, err := filepath.Rel(stowDir, link.Target)
+			if err != nil {
+				target = link.Target
+			}
+			dest, err := filepath.Rel(filepath.Dir(link.Target), link.Source)
+			if err != nil {
+				dest = link.Source
+			}
+
+			switch link.Action {
+			case "copy":
+				fmt.Printf("COPY: %s <= %s\n", target, link.Source)
+			case "mkdir":
+				fmt.Printf("MKDIR: %s\n", target)
+			default:
+				fmt.Printf("LINK: %s => %s\n", target, dest)
+			}
+		}
+	}
+	if !printed {
+		fmt.Println("[INFO] Plan has no links")
+	}
+}
+
+// stowPackage returns the most specific plan source containing source,
+// or "" if none does
+func stowPackage(sources []string, source string) string {
+	pkg := ""
+	for _, src := range sources {
+		if strings.HasPrefix(source, src+string(filepath.Separator)) && len(src) > len(pkg) {
+			pkg = src
+		}
+	}
+	return pkg
+}
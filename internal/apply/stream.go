@@ -0,0 +1,382 @@
+package apply
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// errStreamStopped ends a streaming pass early without being an error
+var errStreamStopped = errors.New("stream stopped")
+
+// planStream reads the links of a plan file incrementally, chunkSize at a
+// time, so a plan never has to be held in memory as a whole
+type planStream struct {
+	file    string
+	chunk   int
+	keep    func(types.Link) bool
+	version string      // Version the links were written with
+	header  *types.Plan // Migrated plan without its links
+}
+
+// openPlanStream reads everything but the links of a plan file. keep
+// selects the links passed on by each; nil keeps all of them.
+func openPlanStream(planFile string, chunkSize int, keep func(types.Link) bool) (*planStream, error) {
+	if planFile == StdioPlan {
+		return nil, fmt.Errorf("streaming apply needs a plan file; stdin can only be read once")
+	}
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	if keep == nil {
+		keep = func(types.Link) bool { return true }
+	}
+
+	ps := &planStream{file: planFile, chunk: chunkSize, keep: keep}
+	header, err := ps.decode(nil)
+	if err != nil {
+		return nil, err
+	}
+	ps.version = header.Version
+	if err := MigratePlan(header); err != nil {
+		return nil, err
+	}
+	ps.header = header
+	return ps, nil
+}
+
+// ReadPlanHeader reads a plan file without keeping its links, for callers
+// that only need the plan's other fields
+func ReadPlanHeader(planFile string) (*types.Plan, error) {
+	ps, err := openPlanStream(planFile, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ps.header, nil
+}
+
+// each passes the kept links to fn in chunks, migrated to the current
+// plan format. The slice is reused between calls. fn may return
+// errStreamStopped to end the pass early.
+func (ps *planStream) each(fn func(links []types.Link) error) error {
+	_, err := ps.decode(fn)
+	if errors.Is(err, errStreamStopped) {
+		return nil
+	}
+	return err
+}
+
+// decode reads the plan file once, handing the links to fn in chunks
+// instead of collecting them. With a nil fn the links are skipped.
+// Returns the plan without its links.
+func (ps *planStream) decode(fn func(links []types.Link) error) (*types.Plan, error) {
+	f, err := os.Open(ps.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan file: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if isGzipPlan(ps.file) {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress plan file: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	chunk := make([]types.Link, 0, ps.chunk)
+	flush := func() error {
+		if len(chunk) == 0 || fn == nil {
+			return nil
+		}
+		links := &types.Plan{Version: ps.version, Links: chunk}
+		if err := MigratePlan(links); err != nil {
+			return err
+		}
+		if err := fn(links.Links); err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse plan file: %w", err)
+		}
+		key, _ := tok.(string)
+		if key != "links" {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("failed to parse plan file: %w", err)
+			}
+			fields[key] = raw
+			continue
+		}
+
+		// Plans without links may have written them as null
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse plan file: %w", err)
+		}
+		if tok == nil {
+			continue
+		}
+		if tok != json.Delim('[') {
+			return nil, fmt.Errorf("failed to parse plan file: expected links array, got %v", tok)
+		}
+		for dec.More() {
+			var link types.Link
+			if err := dec.Decode(&link); err != nil {
+				return nil, fmt.Errorf("failed to parse plan file: %w", err)
+			}
+			if fn == nil || !ps.keep(link) {
+				continue
+			}
+			chunk = append(chunk, link)
+			if len(chunk) == ps.chunk {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse plan file: %w", err)
+	}
+	var header types.Plan
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("failed to parse plan file: %w", err)
+	}
+	return &header, nil
+}
+
+// expectDelim reads the next JSON token and checks it is the delimiter d
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to parse plan file: %w", err)
+	}
+	if tok != d {
+		return fmt.Errorf("failed to parse plan file: expected %q, got %v", d, tok)
+	}
+	return nil
+}
+
+// planWriter writes a plan to a file link by link. The file only replaces
+// its destination on commit.
+type planWriter struct {
+	path   string
+	file   *os.File
+	suffix []byte // Rest of the plan after the links array
+	count  int
+}
+
+// newPlanWriter starts writing a plan with header's fields to path
+func newPlanWriter(path string, header *types.Plan) (*planWriter, error) {
+	h := *header
+	h.Links = []types.Link{}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal plan: %w", err)
+	}
+	marker := []byte(`"links":[`)
+	i := bytes.Index(data, marker)
+	if i < 0 {
+		return nil, fmt.Errorf("failed to marshal plan: no links array")
+	}
+	i += len(marker)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := f.Write(data[:i]); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return &planWriter{path: path, file: f, suffix: data[i:]}, nil
+}
+
+// add appends links to the plan being written
+func (w *planWriter) add(links []types.Link) error {
+	for _, link := range links {
+		data, err := json.Marshal(link)
+		if err != nil {
+			return fmt.Errorf("failed to marshal plan: %w", err)
+		}
+		if w.count > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err := w.file.Write(data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", w.path, err)
+		}
+		w.count++
+	}
+	return nil
+}
+
+// commit finishes the plan and moves it into place
+func (w *planWriter) commit() error {
+	if _, err := w.file.Write(w.suffix); err != nil {
+		w.discard()
+		return fmt.Errorf("failed to write %s: %w", w.path, err)
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write %s: %w", w.path, err)
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write %s: %w", w.path, err)
+	}
+	return nil
+}
+
+// discard abandons the plan being written
+func (w *planWriter) discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// ApplyStream applies a plan file like Apply without loading all of its
+// links at once: the links are decoded incrementally and applied chunkSize
+// at a time. keep selects the links to apply (nil applies all of them).
+//
+// The file is read in several passes: one for the plan's other fields, one
+// to collect the links that need confirmation, and one to apply. The
+// summary prompt of opts.Confirm needs the whole plan and is not supported.
+func (a *Applier) ApplyStream(planFile string, chunkSize int, keep func(types.Link) bool, opts types.ApplyOptions) (err error) {
+	if opts.Confirm {
+		return fmt.Errorf("the --confirm summary needs the whole plan and cannot be used when streaming")
+	}
+
+	ps, err := openPlanStream(planFile, chunkSize, keep)
+	if err != nil {
+		return err
+	}
+	plan := ps.header
+
+	result := newApplyResult(opts)
+	a.lastResult = result
+
+	if opts.Report != "" {
+		defer func() { a.finishReport(opts.Report, result, err) }()
+	}
+
+	fmt.Printf("[INFO] Applying execution plan in chunks of %d links...\n", chunkSize)
+	release, err := beginApply(plan, opts)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Collect what the gates and preApply hooks need without keeping the links
+	gates := newPlanGates(plan.Hooks)
+	total := 0
+	err = ps.each(func(links []types.Link) error {
+		total += len(links)
+		for _, link := range links {
+			gates.add(link)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	confirmed, err := gates.confirm(opts)
+	if err != nil {
+		return err
+	}
+	if err := a.runPreApply(gates.preApplyHooks(confirmed), opts); err != nil {
+		return err
+	}
+
+	prev := loadPreviousPlan()
+
+	// Write the applied plan as it streams by so moves can be detected next time
+	var saved *planWriter
+	if !opts.DryRun {
+		path, err := lastPlanPath()
+		if err == nil {
+			saved, err = newPlanWriter(path, plan)
+		}
+		if err != nil {
+			fmt.Printf("[WARN] Failed to save applied plan: %s\n", err)
+		}
+	}
+
+	run := newApplyRun(result, total, prev, gates.changes.empty())
+	err = ps.each(func(links []types.Link) error {
+		moves := confirmedMoves(prev, links, confirmed)
+		a.applyLinks(links, confirmed, opts, run)
+		result.Errors = append(result.Errors, a.applyMoves(moves, opts, run)...)
+
+		if opts.Report == "" {
+			result.Links = result.Links[:0]
+		}
+
+		if saved != nil {
+			if err := saved.add(links); err != nil {
+				fmt.Printf("[WARN] Failed to save applied plan: %s\n", err)
+				saved.discard()
+				saved = nil
+			}
+		}
+		if run.stopped {
+			return errStreamStopped
+		}
+		return nil
+	})
+	if err != nil {
+		if saved != nil {
+			saved.discard()
+		}
+		return err
+	}
+
+	a.runPostApply(run.changed.hooks(), opts, result)
+
+	run.printSummary()
+
+	if saved != nil {
+		if run.savesPlan(opts) {
+			if err := saved.commit(); err != nil {
+				fmt.Printf("[WARN] Failed to save applied plan: %s\n", err)
+			}
+		} else {
+			saved.discard()
+		}
+	}
+
+	return run.err()
+}
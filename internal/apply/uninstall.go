@@ -0,0 +1,91 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// Uninstall removes CDM-owned symlinks listed in a plan. A target is only
+// removed if it is a symlink pointing at the link's source; copies and
+// foreign files are never touched. With orphansOnly, only links whose
+// source no longer exists are removed.
+func (a *Applier) Uninstall(plan *types.Plan, opts types.ApplyOptions, orphansOnly bool) error {
+	fmt.Printf("[INFO] Uninstalling links...\n")
+
+	if opts.DryRun {
+		fmt.Printf("[WARN] DRY-RUN MODE: No changes will be made\n")
+	}
+
+	if !opts.DryRun && !opts.NoLock {
+		lock, err := acquireLock()
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	var owned, system []types.Link
+	var removed, kept, failed int
+
+	for _, link := range plan.Links {
+		switch link.Action {
+		case "copy", "mkdir":
+			continue
+		case "hardlink":
+			if !fs.IsSameFile(link.Target, link.Source) {
+				continue
+			}
+		default:
+			if !fs.IsOwnedSymlink(link.Target, link.Source) {
+				continue
+			}
+		}
+
+		if orphansOnly {
+			if _, err := os.Stat(link.Source); !os.IsNotExist(err) {
+				kept++
+				continue
+			}
+		}
+
+		owned = append(owned, link)
+		if fs.NeedsSudo(link.Target) {
+			system = append(system, link)
+		}
+	}
+
+	if err := confirmSystem("uninstall", system, opts); err != nil {
+		return err
+	}
+
+	for _, link := range owned {
+		if err := a.sm.RemoveSymlink(link.Target, opts); err != nil {
+			fmt.Printf("[ERROR] %s\n", err)
+			failed++
+			continue
+		}
+		if !a.verbose && !opts.DryRun {
+			fmt.Printf("[REMOVE] %s\n", link.Target)
+		}
+		removed++
+	}
+
+	if failed > 0 {
+		fmt.Printf("[ERROR] Uninstall completed with %d failed links\n", failed)
+	} else {
+		fmt.Printf("[SUCCESS] Uninstall completed\n")
+	}
+	fmt.Printf("  Removed: %d\n", removed)
+	if orphansOnly {
+		fmt.Printf("  Kept: %d\n", kept)
+	}
+	fmt.Printf("  Failed: %d\n", failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d links failed to uninstall", failed)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package apply
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// targetState is what a target looked like at one point of an apply
+type targetState struct {
+	info    os.FileInfo // nil if the target did not exist
+	linkDst string
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// snapshotTarget records the state of a target without following symlinks
+func snapshotTarget(target string) targetState {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return targetState{}
+	}
+	state := targetState{info: info, modTime: info.ModTime(), mode: info.Mode()}
+	if info.Mode()&os.ModeSymlink != 0 {
+		state.linkDst, _ = os.Readlink(target)
+	}
+	return state
+}
+
+// sameState reports whether a target is the same, unmodified file as before
+func sameState(before, after targetState) bool {
+	if before.info == nil || after.info == nil {
+		return before.info == nil && after.info == nil
+	}
+	return os.SameFile(before.info, after.info) &&
+		before.linkDst == after.linkDst &&
+		before.modTime.Equal(after.modTime) &&
+		before.mode == after.mode
+}
+
+// verifyPrediction compares the dry-run classification of a link, made
+// before it was applied, with what applying it actually did: a link
+// predicted to change must be in place afterwards, and a link predicted
+// unchanged must have left its target untouched. Returns a description
+// of the discrepancy, or "" if the prediction held.
+func verifyPrediction(link types.Link, predicted LinkOp, before targetState) string {
+	after := ClassifyLink(link)
+	if predicted != OpUnchanged && after != OpUnchanged {
+		return fmt.Sprintf("predicted %s, but the target still needs %s after apply", predicted, after)
+	}
+	if predicted == OpUnchanged && !sameState(before, snapshotTarget(link.Target)) {
+		return "predicted unchanged, but apply modified the target"
+	}
+	return ""
+}
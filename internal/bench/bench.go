@@ -0,0 +1,127 @@
+// Package bench provides a synthetic self-test for measuring CDM performance
+package bench
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/woodgear/cdm/internal/apply"
+	"github.com/woodgear/cdm/internal/check"
+	"github.com/woodgear/cdm/internal/plan"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// filesPerDir controls how the synthetic tree is fanned out
+const filesPerDir = 100
+
+// Phase holds the timing of one benchmark phase
+type Phase struct {
+	Name     string
+	Duration time.Duration
+	Items    int
+}
+
+// Result holds the timings of a benchmark run
+type Result struct {
+	Files  int
+	Phases []Phase
+}
+
+// Run generates a synthetic source tree with the given number of files in a
+// temp dir and times plan generation, a dry-run apply and a check over it.
+// Targets live under a unique, non-existent directory in $HOME, so nothing
+// on the system is modified.
+func Run(files int, verbose bool) (*Result, error) {
+	if files <= 0 {
+		return nil, fmt.Errorf("number of files must be positive")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "cdm-bench-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	result := &Result{Files: files}
+
+	start := time.Now()
+	if err := generateTree(tmpDir, files); err != nil {
+		return nil, err
+	}
+	result.Phases = append(result.Phases, Phase{Name: "setup", Duration: time.Since(start), Items: files})
+
+	start = time.Now()
+	p, err := plan.NewGenerator(verbose).Generate([]string{tmpDir})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate plan: %w", err)
+	}
+	result.Phases = append(result.Phases, Phase{Name: "generate", Duration: time.Since(start), Items: len(p.Links)})
+
+	// Dry-run apply prints a line per link; keep it off the terminal
+	// unless verbose output was requested
+	start = time.Now()
+	err = withSilencedStdout(!verbose, func() error {
+		return apply.NewApplier(verbose).Apply(p, types.ApplyOptions{DryRun: true, Yes: true})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply plan: %w", err)
+	}
+	result.Phases = append(result.Phases, Phase{Name: "apply (dry-run)", Duration: time.Since(start), Items: len(p.Links)})
+
+	start = time.Now()
+	check.NewChecker(verbose).CheckPlan(p)
+	result.Phases = append(result.Phases, Phase{Name: "check", Duration: time.Since(start), Items: len(p.Links)})
+
+	return result, nil
+}
+
+// generateTree writes the synthetic source tree
+func generateTree(root string, files int) error {
+	base := filepath.Join(root, "home", filepath.Base(root))
+	for i := 0; i < files; i++ {
+		dir := filepath.Join(base, fmt.Sprintf("dir%04d", i/filesPerDir))
+		if i%filesPerDir == 0 {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", dir, err)
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("file%04d.conf", i%filesPerDir))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("# file %d\n", i)), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// withSilencedStdout runs fn with os.Stdout redirected to /dev/null
+func withSilencedStdout(silence bool, fn func() error) error {
+	if !silence {
+		return fn()
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return fn()
+	}
+	defer devNull.Close()
+
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	return fn()
+}
+
+// PrintResult prints per-phase timings and throughput
+func PrintResult(result *Result) {
+	fmt.Printf("[INFO] Benchmark: %d files\n", result.Files)
+	var total time.Duration
+	for _, phase := range result.Phases {
+		total += phase.Duration
+		rate := float64(phase.Items) / phase.Duration.Seconds()
+		fmt.Printf("  %-16s %12s  %10.0f files/s\n", phase.Name, phase.Duration.Round(time.Microsecond), rate)
+	}
+	fmt.Printf("  %-16s %12s\n", "total", total.Round(time.Microsecond))
+}
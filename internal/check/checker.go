@@ -4,15 +4,22 @@ package check
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/woodgear/cdm/internal/apply"
 	"github.com/woodgear/cdm/internal/fs"
 	"github.com/woodgear/cdm/pkg/types"
 )
 
 // Checker verifies the status of symlinks against a plan
 type Checker struct {
-	verbose bool
+	verbose       bool
+	workers       int  // Concurrent link checks; 1 or less checks serially
+	followSources bool // Accept links that resolve to the same file as their source
 }
 
 // NewChecker creates a new checker
@@ -20,20 +27,39 @@ func NewChecker(verbose bool) *Checker {
 	return &Checker{verbose: verbose}
 }
 
+// SetWorkers sets how many links CheckPlan checks concurrently
+func (c *Checker) SetWorkers(n int) {
+	c.workers = n
+}
+
+// SetFollowSourceSymlinks makes symlink checks resolve both the target and
+// the source with filepath.EvalSymlinks when the link value differs from
+// the planned source, reporting OK if they reach the same file
+func (c *Checker) SetFollowSourceSymlinks(follow bool) {
+	c.followSources = follow
+}
+
 // CheckPlan verifies all links in a plan against the current environment
 func (c *Checker) CheckPlan(plan *types.Plan) *types.CheckReport {
 	report := &types.CheckReport{
+		Hostname: plan.Hostname,
 		Total:    len(plan.Links),
 		ByStatus: make(map[types.LinkStatus]int),
-		Results:  make([]types.CheckResult, 0, len(plan.Links)),
+		Results:  make([]types.CheckResult, len(plan.Links)),
 		AllOK:    true,
 	}
 
-	for _, link := range plan.Links {
-		result := c.checkLink(link)
-		report.Results = append(report.Results, result)
-		report.ByStatus[result.Status]++
+	if c.workers > 1 {
+		c.checkConcurrently(plan.Links, report.Results)
+	} else {
+		for i, link := range plan.Links {
+			report.Results[i] = c.checkLinkWithMode(link)
+		}
+	}
 
+	// Aggregate after the concurrent phase so counts need no locking
+	for _, result := range report.Results {
+		report.ByStatus[result.Status]++
 		if result.Status != types.StatusOK {
 			report.AllOK = false
 		}
@@ -42,14 +68,89 @@ func (c *Checker) CheckPlan(plan *types.Plan) *types.CheckReport {
 	return report
 }
 
+// checkConcurrently checks links with a bounded worker pool. Each worker
+// writes only the result slots of the indexes it receives, so results keep
+// the plan's order.
+func (c *Checker) checkConcurrently(links []types.Link, results []types.CheckResult) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = c.checkLinkWithMode(links[i])
+			}
+		}()
+	}
+	for i := range links {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// checkLinkWithMode checks a link and, if it is OK, its configured mode
+// and extended attributes
+func (c *Checker) checkLinkWithMode(link types.Link) types.CheckResult {
+	result := c.checkLink(link)
+	if result.Status == types.StatusOK && link.Mode != "" {
+		result = checkLinkMode(result)
+	}
+	if result.Status == types.StatusOK && len(link.Xattrs) > 0 {
+		if detail, ok := fs.CheckXattrs(link.Target, link.Xattrs); !ok {
+			result.Status = types.StatusWrongXattr
+			result.Detail = detail
+		}
+	}
+	return result
+}
+
 // checkLink checks a single link and returns its status
 func (c *Checker) checkLink(link types.Link) types.CheckResult {
-	if link.Action == "copy" {
+	switch link.Action {
+	case "copy":
 		return c.checkCopy(link)
+	case "hardlink":
+		return c.checkHardlink(link)
+	case "mkdir":
+		return c.checkDir(link)
 	}
 	return c.checkSymlink(link)
 }
 
+// checkHardlink checks a hard link entry by comparing inodes
+func (c *Checker) checkHardlink(link types.Link) types.CheckResult {
+	result := types.CheckResult{
+		Link: link,
+	}
+
+	if _, err := os.Stat(link.Source); os.IsNotExist(err) {
+		result.Status = types.StatusSourceMissing
+		result.Detail = fmt.Sprintf("source file does not exist: %s", link.Source)
+		return result
+	}
+
+	if _, err := os.Lstat(link.Target); os.IsNotExist(err) {
+		return missingTarget(result)
+	}
+
+	if fs.IsDirConflict(link.Target, link.Source) {
+		result.Status = types.StatusTargetIsDir
+		result.Detail = "target is a directory but the source is a file"
+		return result
+	}
+
+	if fs.IsSameFile(link.Target, link.Source) {
+		result.Status = types.StatusOK
+		result.Detail = "hard linked"
+	} else {
+		result.Status = types.StatusNotHardlink
+		result.Detail = "target is not the same file as the source"
+	}
+	return result
+}
+
 // checkSymlink checks a symlink entry
 func (c *Checker) checkSymlink(link types.Link) types.CheckResult {
 	result := types.CheckResult{
@@ -66,9 +167,7 @@ func (c *Checker) checkSymlink(link types.Link) types.CheckResult {
 	// Check if target exists
 	info, err := os.Lstat(link.Target)
 	if os.IsNotExist(err) {
-		result.Status = types.StatusMissing
-		result.Detail = "target does not exist"
-		return result
+		return missingTarget(result)
 	}
 	if err != nil {
 		result.Status = types.StatusMissing
@@ -76,6 +175,13 @@ func (c *Checker) checkSymlink(link types.Link) types.CheckResult {
 		return result
 	}
 
+	// A real directory where a file link belongs
+	if fs.IsDirConflict(link.Target, link.Source) {
+		result.Status = types.StatusTargetIsDir
+		result.Detail = "target is a directory but the source is a file"
+		return result
+	}
+
 	// Check if target is a symlink
 	if info.Mode()&os.ModeSymlink == 0 {
 		result.Status = types.StatusNotSymlink
@@ -91,9 +197,12 @@ func (c *Checker) checkSymlink(link types.Link) types.CheckResult {
 		return result
 	}
 
-	if actualSource == link.Source {
+	if fs.SamePath(fs.ResolveLinkDest(link.Target, actualSource), filepath.Clean(link.Source)) {
 		result.Status = types.StatusOK
 		result.Detail = "correctly linked"
+	} else if c.followSources && resolveToSameFile(link.Target, link.Source) {
+		result.Status = types.StatusOK
+		result.Detail = fmt.Sprintf("points to %s, which resolves to the source", actualSource)
 	} else {
 		result.Status = types.StatusWrongLink
 		result.Detail = fmt.Sprintf("points to: %s", actualSource)
@@ -102,6 +211,176 @@ func (c *Checker) checkSymlink(link types.Link) types.CheckResult {
 	return result
 }
 
+// resolveToSameFile reports whether two paths resolve, following every
+// symlink, to the same location
+func resolveToSameFile(a, b string) bool {
+	ra, err := filepath.EvalSymlinks(a)
+	if err != nil {
+		return false
+	}
+	rb, err := filepath.EvalSymlinks(b)
+	if err != nil {
+		return false
+	}
+	return fs.SamePath(ra, rb)
+}
+
+// checkLinkMode downgrades an OK result to WRONG_MODE when the file holding
+// the content (source for links, target for copies) has drifted from the
+// configured permissions
+func checkLinkMode(result types.CheckResult) types.CheckResult {
+	path := result.Link.Source
+	if result.Link.Action == "copy" || result.Link.Action == "mkdir" {
+		path = result.Link.Target
+	}
+	if detail, ok := fs.CheckMode(path, result.Link.Mode); !ok {
+		result.Status = types.StatusWrongMode
+		result.Detail = detail
+	}
+	return result
+}
+
+// missingTarget fills in the status for a target that does not exist,
+// distinguishing a missing parent directory from a missing target
+func missingTarget(result types.CheckResult) types.CheckResult {
+	parent := filepath.Dir(result.Link.Target)
+	if _, err := os.Stat(parent); os.IsNotExist(err) {
+		result.Status = types.StatusParentMissing
+		result.Detail = fmt.Sprintf("parent directory does not exist: %s", parent)
+		return result
+	}
+
+	result.Status = types.StatusMissing
+	result.Detail = "target does not exist"
+	return result
+}
+
+// ResolveTargets fills in the fully resolved real path of each target by
+// following the whole symlink chain. Targets that cannot be resolved
+// (missing or dangling) get a description of the failure instead.
+func (c *Checker) ResolveTargets(report *types.CheckReport) {
+	for i := range report.Results {
+		result := &report.Results[i]
+
+		resolved, err := filepath.EvalSymlinks(result.Link.Target)
+		if err != nil {
+			if _, lerr := os.Lstat(result.Link.Target); lerr == nil {
+				result.Resolved = "(dangling)"
+			} else {
+				result.Resolved = "(missing)"
+			}
+			continue
+		}
+		result.Resolved = resolved
+	}
+}
+
+// CheckDereference follows OK targets to their content and downgrades them
+// to DANGLING when the resolved file is missing or unreadable, or to EMPTY
+// when it is a zero-byte regular file
+func (c *Checker) CheckDereference(report *types.CheckReport) {
+	for i := range report.Results {
+		result := &report.Results[i]
+		if result.Status != types.StatusOK {
+			continue
+		}
+
+		status, detail := dereference(result.Link.Target)
+		if status == types.StatusOK {
+			continue
+		}
+
+		report.ByStatus[result.Status]--
+		result.Status = status
+		result.Detail = detail
+		report.ByStatus[result.Status]++
+		report.AllOK = false
+	}
+}
+
+// dereference stats and opens the file a target resolves to
+func dereference(target string) (types.LinkStatus, string) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return types.StatusDangling, fmt.Sprintf("resolved path is unreachable: %v", err)
+	}
+	if info.IsDir() {
+		// Folder links have no content of their own to verify
+		return types.StatusOK, ""
+	}
+	if !info.Mode().IsRegular() {
+		return types.StatusDangling, "resolved path is not a regular file"
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return types.StatusDangling, fmt.Sprintf("resolved file is not readable: %v", err)
+	}
+	f.Close()
+
+	if info.Size() == 0 {
+		return types.StatusEmpty, "resolved file is empty"
+	}
+	return types.StatusOK, ""
+}
+
+// RepairMissingDirs creates the parent directories of PARENT_MISSING targets.
+// Returns the directories that were (or would be, in dry-run) created.
+func (c *Checker) RepairMissingDirs(report *types.CheckReport, dryRun bool) ([]string, error) {
+	seen := make(map[string]bool)
+	var repaired []string
+
+	for _, result := range report.Results {
+		if result.Status != types.StatusParentMissing {
+			continue
+		}
+
+		parent := filepath.Dir(result.Link.Target)
+		if seen[parent] {
+			continue
+		}
+		seen[parent] = true
+
+		if dryRun {
+			fmt.Printf("[DRY-RUN] Would create directory: %s\n", parent)
+		} else {
+			if err := os.MkdirAll(parent, 0755); err != nil {
+				return repaired, fmt.Errorf("failed to create directory %s: %w", parent, err)
+			}
+			if c.verbose {
+				fmt.Printf("[MKDIR] %s\n", parent)
+			}
+		}
+		repaired = append(repaired, parent)
+	}
+
+	return repaired, nil
+}
+
+// checkDir checks a mkdir entry: the target only has to be a directory
+func (c *Checker) checkDir(link types.Link) types.CheckResult {
+	result := types.CheckResult{
+		Link: link,
+	}
+
+	info, err := os.Stat(link.Target)
+	switch {
+	case os.IsNotExist(err):
+		result.Status = types.StatusMissing
+		result.Detail = "directory does not exist"
+	case err != nil:
+		result.Status = types.StatusMismatch
+		result.Detail = fmt.Sprintf("failed to stat: %v", err)
+	case !info.IsDir():
+		result.Status = types.StatusMismatch
+		result.Detail = "target exists but is not a directory"
+	default:
+		result.Status = types.StatusOK
+		result.Detail = "directory exists"
+	}
+	return result
+}
+
 // checkCopy checks a copy entry by comparing file contents
 func (c *Checker) checkCopy(link types.Link) types.CheckResult {
 	result := types.CheckResult{
@@ -117,8 +396,12 @@ func (c *Checker) checkCopy(link types.Link) types.CheckResult {
 
 	// Check if target exists
 	if _, err := os.Stat(link.Target); os.IsNotExist(err) {
-		result.Status = types.StatusMissing
-		result.Detail = "target does not exist"
+		return missingTarget(result)
+	}
+
+	if fs.IsDirConflict(link.Target, link.Source) {
+		result.Status = types.StatusTargetIsDir
+		result.Detail = "target is a directory but the source is a file"
 		return result
 	}
 
@@ -141,56 +424,164 @@ func (c *Checker) checkCopy(link types.Link) types.CheckResult {
 	return result
 }
 
+// statusOrder is the order statuses are listed in group subtotals
+var statusOrder = []types.LinkStatus{
+	types.StatusOK,
+	types.StatusMissing,
+	types.StatusWrongLink,
+	types.StatusNotSymlink,
+	types.StatusSourceMissing,
+	types.StatusMismatch,
+	types.StatusParentMissing,
+	types.StatusWrongOwner,
+	types.StatusTargetIsDir,
+	types.StatusWrongMode,
+	types.StatusDangling,
+	types.StatusEmpty,
+	types.StatusNotHardlink,
+	types.StatusWrongXattr,
+}
+
+// ParseStatuses converts status names (case-insensitive) to link statuses
+func ParseStatuses(names []string) ([]types.LinkStatus, error) {
+	statuses := make([]types.LinkStatus, 0, len(names))
+	for _, name := range names {
+		status := types.LinkStatus(strings.ToUpper(strings.TrimSpace(name)))
+		known := false
+		for _, s := range statusOrder {
+			if s == status {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown link status %q", name)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CountStatuses returns the number of results with one of the given
+// statuses, or the number of non-OK results if none are given
+func CountStatuses(report *types.CheckReport, statuses []types.LinkStatus) int {
+	count := 0
+	if len(statuses) == 0 {
+		for status, n := range report.ByStatus {
+			if status != types.StatusOK {
+				count += n
+			}
+		}
+		return count
+	}
+	for _, status := range statuses {
+		count += report.ByStatus[status]
+	}
+	return count
+}
+
 // PrintReport prints a formatted check report (Unix style)
 func PrintReport(report *types.CheckReport, verbose bool, ignoreOK bool) {
+	printResults(report.Results, ignoreOK)
+}
+
+// PrintGroupedReport prints a check report split into a home group and a
+// root group (system paths that need sudo), each followed by subtotals
+func PrintGroupedReport(report *types.CheckReport, verbose bool, ignoreOK bool) {
+	var home, root []types.CheckResult
+	for _, result := range report.Results {
+		if fs.NeedsSudo(result.Link.Target) {
+			root = append(root, result)
+		} else {
+			home = append(home, result)
+		}
+	}
+
+	first := true
+	for _, group := range []struct {
+		name    string
+		results []types.CheckResult
+	}{{"home", home}, {"root", root}} {
+		if len(group.results) == 0 {
+			continue
+		}
+		if !first {
+			fmt.Println()
+		}
+		first = false
+
+		fmt.Printf("# %s\n", group.name)
+		printResults(group.results, ignoreOK)
+
+		counts := make(map[types.LinkStatus]int)
+		for _, result := range group.results {
+			counts[result.Status]++
+		}
+		var parts []string
+		for _, status := range statusOrder {
+			if counts[status] > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d", status, counts[status]))
+			}
+		}
+		fmt.Printf("[INFO] %s: %d targets (%s)\n", group.name, len(group.results), strings.Join(parts, ", "))
+	}
+}
+
+// printResults prints one tab-separated line per result
+func printResults(results []types.CheckResult, ignoreOK bool) {
 	// Status labels
 	labels := map[types.LinkStatus]string{
-		types.StatusOK:           "OK",
-		types.StatusMissing:      "MISSING",
-		types.StatusWrongLink:    "WRONG_LINK",
-		types.StatusNotSymlink:   "NOT_SYMLINK",
+		types.StatusOK:            "OK",
+		types.StatusMissing:       "MISSING",
+		types.StatusWrongLink:     "WRONG_LINK",
+		types.StatusNotSymlink:    "NOT_SYMLINK",
 		types.StatusSourceMissing: "SOURCE_MISSING",
-		types.StatusMismatch:     "MISMATCH",
+		types.StatusMismatch:      "MISMATCH",
+		types.StatusParentMissing: "PARENT_MISSING",
+		types.StatusWrongOwner:    "WRONG_OWNER",
+		types.StatusTargetIsDir:   "TARGET_IS_DIR",
+		types.StatusWrongMode:     "WRONG_MODE",
+		types.StatusDangling:      "DANGLING",
+		types.StatusEmpty:         "EMPTY",
+		types.StatusNotHardlink:   "NOT_HARDLINK",
+		types.StatusWrongXattr:    "WRONG_XATTR",
 	}
 
 	// Print results to stdout
-	for _, result := range report.Results {
+	for _, result := range results {
 		if ignoreOK && result.Status == types.StatusOK {
 			continue
 		}
 		label := labels[result.Status]
 		source := result.Link.Source
 		target := result.Link.Target
-		fmt.Printf("%s\t%s\t%s\n", label, source, target)
+		if result.Resolved != "" {
+			fmt.Printf("%s\t%s\t%s\t=> %s\n", label, source, target, result.Resolved)
+		} else {
+			fmt.Printf("%s\t%s\t%s\n", label, source, target)
+		}
 	}
 }
 
-// CheckFromFile reads a plan file and checks it
-func (c *Checker) CheckFromFile(planFile string) (*types.CheckReport, error) {
-	plan, err := readPlanFile(planFile)
+// WriteJSON writes a check report as JSON
+func WriteJSON(w io.Writer, report *types.CheckReport) error {
+	if report.Home == "" {
+		report.Home, _ = os.UserHomeDir()
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to marshal check report: %w", err)
 	}
-
-	return c.CheckPlan(plan), nil
+	_, err = w.Write(append(data, '\n'))
+	return err
 }
 
-// readPlanFile reads a plan from a JSON file
-func readPlanFile(planFile string) (*types.Plan, error) {
-	data, err := os.ReadFile(planFile)
+// CheckFromFile reads a plan file and checks it
+func (c *Checker) CheckFromFile(planFile string) (*types.CheckReport, error) {
+	plan, err := apply.ReadPlan(planFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read plan file: %w", err)
-	}
-
-	var plan types.Plan
-	if err := parsePlan(data, &plan); err != nil {
-		return nil, fmt.Errorf("failed to parse plan file: %w", err)
+		return nil, err
 	}
 
-	return &plan, nil
-}
-
-// parsePlan parses JSON data into a Plan struct
-func parsePlan(data []byte, plan *types.Plan) error {
-	return json.Unmarshal(data, plan)
+	return c.CheckPlan(plan), nil
 }
@@ -0,0 +1,119 @@
+package check
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// ReportDiff is a target whose check result differs between two systems
+type ReportDiff struct {
+	Target string // Home-relative ("~/...") or absolute target path
+	Local  *types.CheckResult
+	Remote *types.CheckResult
+}
+
+// RemoteCheck runs "check --json" on a remote host over SSH and parses the
+// report. The remote exits non-zero when links need attention, so the exit
+// status is ignored as long as a report was printed.
+func RemoteCheck(host, cdmCmd string, args []string) (*types.CheckReport, error) {
+	remoteArgs := append([]string{cdmCmd, "check", "--json"}, args...)
+	for i, arg := range remoteArgs {
+		remoteArgs[i] = fs.ShellQuote(arg)
+	}
+
+	cmd := exec.Command("ssh", host, strings.Join(remoteArgs, " "))
+	cmd.Stderr = os.Stderr
+	output, runErr := cmd.Output()
+
+	var report types.CheckReport
+	if err := json.Unmarshal(bytes.TrimSpace(output), &report); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("remote check on %s failed: %w", host, runErr)
+		}
+		return nil, fmt.Errorf("failed to parse remote check report from %s: %w", host, err)
+	}
+	if report.Hostname == "" {
+		report.Hostname = host
+	}
+	return &report, nil
+}
+
+// homeRelative rewrites a path under home as "~/..." so paths from systems
+// with different home directories can be compared
+func homeRelative(path, home string) string {
+	if home != "" && strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return "~" + strings.TrimPrefix(path, home)
+	}
+	return path
+}
+
+// CompareReports returns the targets whose status or source differs between
+// two reports, including targets only one of them has. Paths under each
+// system's home directory are compared home-relative.
+func CompareReports(local, remote *types.CheckReport) []ReportDiff {
+	index := func(report *types.CheckReport) map[string]*types.CheckResult {
+		m := make(map[string]*types.CheckResult, len(report.Results))
+		for i := range report.Results {
+			r := &report.Results[i]
+			m[homeRelative(r.Link.Target, report.Home)] = r
+		}
+		return m
+	}
+	localByTarget := index(local)
+	remoteByTarget := index(remote)
+
+	targets := make(map[string]bool)
+	for t := range localByTarget {
+		targets[t] = true
+	}
+	for t := range remoteByTarget {
+		targets[t] = true
+	}
+	sorted := make([]string, 0, len(targets))
+	for t := range targets {
+		sorted = append(sorted, t)
+	}
+	sort.Strings(sorted)
+
+	var diffs []ReportDiff
+	for _, target := range sorted {
+		l, r := localByTarget[target], remoteByTarget[target]
+		if l != nil && r != nil && l.Status == r.Status &&
+			homeRelative(l.Link.Source, local.Home) == homeRelative(r.Link.Source, remote.Home) {
+			continue
+		}
+		diffs = append(diffs, ReportDiff{Target: target, Local: l, Remote: r})
+	}
+	return diffs
+}
+
+// PrintDiffs prints report differences as tab-separated lines
+func PrintDiffs(diffs []ReportDiff, local, remote *types.CheckReport) {
+	describe := func(r *types.CheckResult, home string) string {
+		if r == nil {
+			return "(not planned)"
+		}
+		return fmt.Sprintf("%s (%s)", r.Status, homeRelative(r.Link.Source, home))
+	}
+
+	for _, d := range diffs {
+		kind := "DIFF"
+		switch {
+		case d.Remote == nil:
+			kind = "LOCAL_ONLY"
+		case d.Local == nil:
+			kind = "REMOTE_ONLY"
+		}
+		fmt.Printf("%s\t%s\t%s: %s\t%s: %s\n", kind, d.Target,
+			local.Hostname, describe(d.Local, local.Home), remote.Hostname, describe(d.Remote, remote.Home))
+	}
+}
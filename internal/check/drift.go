@@ -0,0 +1,75 @@
+package check
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// Drift kinds
+const (
+	DriftMissing = "MISSING" // Target is generated from the sources but not in the plan
+	DriftExtra   = "EXTRA"   // Target is in the plan but no longer generated
+	DriftChanged = "CHANGED" // Target's source or action differs from the sources
+)
+
+// PlanDrift is a target where a written plan and a plan regenerated from
+// the current sources disagree
+type PlanDrift struct {
+	Kind      string
+	Target    string
+	Planned   *types.Link // Link in the written plan, nil for MISSING
+	Generated *types.Link // Link regenerated from the sources, nil for EXTRA
+}
+
+// ComparePlans compares a written plan with one regenerated from the
+// sources by target, source and action. Entries are sorted by target.
+func ComparePlans(planned, generated *types.Plan) []PlanDrift {
+	plannedLinks := make(map[string]*types.Link, len(planned.Links))
+	for i := range planned.Links {
+		plannedLinks[fs.PathKey(planned.Links[i].Target)] = &planned.Links[i]
+	}
+
+	var drifts []PlanDrift
+	seen := make(map[string]bool, len(generated.Links))
+	for i := range generated.Links {
+		link := &generated.Links[i]
+		key := fs.PathKey(link.Target)
+		seen[key] = true
+
+		old := plannedLinks[key]
+		switch {
+		case old == nil:
+			drifts = append(drifts, PlanDrift{Kind: DriftMissing, Target: link.Target, Generated: link})
+		case old.Source != link.Source || old.Action != link.Action:
+			drifts = append(drifts, PlanDrift{Kind: DriftChanged, Target: link.Target, Planned: old, Generated: link})
+		}
+	}
+	for i := range planned.Links {
+		old := &planned.Links[i]
+		if !seen[fs.PathKey(old.Target)] {
+			drifts = append(drifts, PlanDrift{Kind: DriftExtra, Target: old.Target, Planned: old})
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Target < drifts[j].Target })
+	return drifts
+}
+
+// PrintPlanDrift prints plan drifts as tab-separated lines
+func PrintPlanDrift(drifts []PlanDrift) {
+	for _, d := range drifts {
+		var change string
+		switch d.Kind {
+		case DriftMissing:
+			change = fmt.Sprintf("%s (%s)", d.Generated.Source, d.Generated.Action)
+		case DriftChanged:
+			change = fmt.Sprintf("%s (%s) => %s (%s)", d.Planned.Source, d.Planned.Action, d.Generated.Source, d.Generated.Action)
+		case DriftExtra:
+			change = fmt.Sprintf("%s (%s)", d.Planned.Source, d.Planned.Action)
+		}
+		fmt.Printf("%s\t%s\t%s\n", d.Kind, d.Target, change)
+	}
+}
@@ -0,0 +1,107 @@
+package check
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// Impact kinds
+const (
+	ImpactNew     = "NEW"     // Target is not in the previous plan
+	ImpactChanged = "CHANGED" // Target's source or action differs from the previous plan
+	ImpactRemoved = "REMOVED" // Target is no longer planned
+)
+
+// ImpactEntry is a target a new plan would create, change or drop
+type ImpactEntry struct {
+	Kind   string
+	Target string
+	Before *types.Link      // Link in the previous plan, nil for NEW
+	After  *types.Link      // Link in the new plan, nil for REMOVED
+	Status types.LinkStatus // Current status of Before, or of After for NEW
+}
+
+// Disturbs reports whether the entry changes or drops a link that is
+// currently OK
+func (e ImpactEntry) Disturbs() bool {
+	return e.Kind != ImpactNew && e.Status == types.StatusOK
+}
+
+// Impact compares a new plan with the previously applied one and checks
+// the current state of every target it would affect. New links that are
+// already in place are not reported. Entries are sorted by target.
+func (c *Checker) Impact(prev, next *types.Plan) []ImpactEntry {
+	prevLinks := make(map[string]*types.Link)
+	if prev != nil {
+		for i := range prev.Links {
+			prevLinks[fs.PathKey(prev.Links[i].Target)] = &prev.Links[i]
+		}
+	}
+
+	var entries []ImpactEntry
+	seen := make(map[string]bool, len(next.Links))
+	for i := range next.Links {
+		link := &next.Links[i]
+		key := fs.PathKey(link.Target)
+		seen[key] = true
+
+		old := prevLinks[key]
+		switch {
+		case old == nil:
+			status := c.checkLinkWithMode(*link).Status
+			if status == types.StatusOK {
+				continue
+			}
+			entries = append(entries, ImpactEntry{Kind: ImpactNew, Target: link.Target, After: link, Status: status})
+		case old.Source != link.Source || old.Action != link.Action:
+			status := c.checkLinkWithMode(*old).Status
+			entries = append(entries, ImpactEntry{Kind: ImpactChanged, Target: link.Target, Before: old, After: link, Status: status})
+		}
+	}
+	if prev != nil {
+		for i := range prev.Links {
+			old := &prev.Links[i]
+			if seen[fs.PathKey(old.Target)] {
+				continue
+			}
+			status := c.checkLinkWithMode(*old).Status
+			entries = append(entries, ImpactEntry{Kind: ImpactRemoved, Target: old.Target, Before: old, Status: status})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Target < entries[j].Target })
+	return entries
+}
+
+// PrintImpact prints impact entries as tab-separated lines, marking the
+// currently-OK links that would be disturbed
+func PrintImpact(entries []ImpactEntry) {
+	disturbed := 0
+	for _, e := range entries {
+		var change string
+		switch e.Kind {
+		case ImpactNew:
+			change = e.After.Source
+		case ImpactChanged:
+			change = fmt.Sprintf("%s => %s", e.Before.Source, e.After.Source)
+		case ImpactRemoved:
+			change = e.Before.Source
+		}
+
+		mark := ""
+		if e.Disturbs() {
+			mark = "\t[DISTURBS OK]"
+			disturbed++
+		}
+		fmt.Printf("%s\t%s\t%s\t(now %s)%s\n", e.Kind, e.Target, change, e.Status, mark)
+	}
+
+	if disturbed > 0 {
+		fmt.Printf("[WARN] %d currently-OK links would be changed or removed\n", disturbed)
+	} else {
+		fmt.Println("[INFO] No currently-OK links would be disturbed")
+	}
+}
@@ -0,0 +1,73 @@
+package check
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// Claim is a plan's link for a target
+type Claim struct {
+	Plan   string // Plan file name
+	Source string
+	Action string
+}
+
+// Overlap is a target claimed by more than one plan
+type Overlap struct {
+	Target string
+	Claims []Claim
+}
+
+// FindOverlaps indexes the targets of several plans and returns those
+// claimed by more than one of them, sorted by target. names[i] labels
+// plans[i] in the result.
+func FindOverlaps(names []string, plans []*types.Plan) []Overlap {
+	index := make(map[string]*Overlap)
+	for i, p := range plans {
+		for _, link := range p.Links {
+			key := fs.PathKey(link.Target)
+			o := index[key]
+			if o == nil {
+				o = &Overlap{Target: link.Target}
+				index[key] = o
+			}
+			// A plan claims each target once; its own duplicates are not overlaps
+			if n := len(o.Claims); n > 0 && o.Claims[n-1].Plan == names[i] {
+				continue
+			}
+			o.Claims = append(o.Claims, Claim{Plan: names[i], Source: link.Source, Action: link.Action})
+		}
+	}
+
+	var overlaps []Overlap
+	for _, o := range index {
+		if len(o.Claims) > 1 {
+			overlaps = append(overlaps, *o)
+		}
+	}
+	sort.Slice(overlaps, func(i, j int) bool { return overlaps[i].Target < overlaps[j].Target })
+	return overlaps
+}
+
+// PrintOverlaps prints each overlapping target followed by its claims
+func PrintOverlaps(overlaps []Overlap) {
+	for _, o := range overlaps {
+		same := true
+		for _, c := range o.Claims[1:] {
+			if c.Source != o.Claims[0].Source || c.Action != o.Claims[0].Action {
+				same = false
+			}
+		}
+		note := "conflicting sources"
+		if same {
+			note = "same source"
+		}
+		fmt.Printf("OVERLAP\t%s\t(%d plans, %s)\n", o.Target, len(o.Claims), note)
+		for _, c := range o.Claims {
+			fmt.Printf("  %s\t%s %s\n", c.Plan, c.Action, c.Source)
+		}
+	}
+}
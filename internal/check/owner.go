@@ -0,0 +1,84 @@
+package check
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// CheckOwnership verifies the uid/gid of targets that have an expected owner.
+// Results that are otherwise OK are downgraded to WRONG_OWNER on mismatch.
+func (c *Checker) CheckOwnership(report *types.CheckReport) {
+	for i := range report.Results {
+		result := &report.Results[i]
+		if result.Status != types.StatusOK || result.Link.Owner == "" {
+			continue
+		}
+
+		detail, ok := checkOwner(result.Link.Target, result.Link.Owner)
+		if ok {
+			continue
+		}
+
+		report.ByStatus[result.Status]--
+		result.Status = types.StatusWrongOwner
+		result.Detail = detail
+		report.ByStatus[result.Status]++
+		report.AllOK = false
+	}
+}
+
+// checkOwner compares a target's owner with an expected "user[:group]"
+func checkOwner(target, owner string) (string, bool) {
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return err.Error(), false
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil {
+		return fmt.Sprintf("failed to stat target: %v", err), false
+	}
+	fileUID, fileGID, ok := fileOwner(info)
+	if !ok {
+		return "ownership not supported on this platform", false
+	}
+
+	if fileUID != uid || (gid >= 0 && fileGID != gid) {
+		return fmt.Sprintf("owner is %d:%d, expected %s", fileUID, fileGID, owner), false
+	}
+	return "", true
+}
+
+// lookupOwner resolves "user[:group]" (names or numeric ids) to uid/gid.
+// gid is -1 when no group is given.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	userPart, groupPart, hasGroup := strings.Cut(owner, ":")
+
+	uid, err = strconv.Atoi(userPart)
+	if err != nil {
+		u, lerr := user.Lookup(userPart)
+		if lerr != nil {
+			return 0, 0, fmt.Errorf("unknown owner user %q", userPart)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	gid = -1
+	if hasGroup && groupPart != "" {
+		gid, err = strconv.Atoi(groupPart)
+		if err != nil {
+			g, lerr := user.LookupGroup(groupPart)
+			if lerr != nil {
+				return 0, 0, fmt.Errorf("unknown owner group %q", groupPart)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
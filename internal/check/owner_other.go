@@ -0,0 +1,11 @@
+//go:build !unix
+
+package check
+
+import "os"
+
+// fileOwner returns the uid and gid of a file. File ownership is not
+// available on this platform.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
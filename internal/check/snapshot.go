@@ -0,0 +1,121 @@
+package check
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// Drift is a target whose state changed since a snapshot
+type Drift struct {
+	Target string
+	Before *types.TargetSnapshot // nil: target was not in the snapshot
+	After  *types.TargetSnapshot // nil: target is no longer planned
+}
+
+// NewSnapshot records each target's status and raw symlink value
+func NewSnapshot(report *types.CheckReport) *types.LinkSnapshot {
+	snapshot := &types.LinkSnapshot{
+		Timestamp: time.Now(),
+		Hostname:  report.Hostname,
+		Targets:   make([]types.TargetSnapshot, 0, len(report.Results)),
+	}
+	for _, result := range report.Results {
+		readlink, _ := os.Readlink(result.Link.Target)
+		snapshot.Targets = append(snapshot.Targets, types.TargetSnapshot{
+			Target:   result.Link.Target,
+			Source:   result.Link.Source,
+			Readlink: readlink,
+			Status:   result.Status,
+		})
+	}
+	return snapshot
+}
+
+// WriteSnapshot writes a snapshot as JSON
+func WriteSnapshot(path string, snapshot *types.LinkSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot
+func ReadSnapshot(path string) (*types.LinkSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var snapshot types.LinkSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+	}
+	return &snapshot, nil
+}
+
+// CompareSnapshots returns the targets whose status, source or symlink
+// value differs between two snapshots, sorted by target
+func CompareSnapshots(before, after *types.LinkSnapshot) []Drift {
+	index := func(s *types.LinkSnapshot) map[string]*types.TargetSnapshot {
+		m := make(map[string]*types.TargetSnapshot, len(s.Targets))
+		for i := range s.Targets {
+			m[s.Targets[i].Target] = &s.Targets[i]
+		}
+		return m
+	}
+	beforeByTarget := index(before)
+	afterByTarget := index(after)
+
+	var targets []string
+	for t := range beforeByTarget {
+		targets = append(targets, t)
+	}
+	for t := range afterByTarget {
+		if beforeByTarget[t] == nil {
+			targets = append(targets, t)
+		}
+	}
+	sort.Strings(targets)
+
+	var drifts []Drift
+	for _, target := range targets {
+		b, a := beforeByTarget[target], afterByTarget[target]
+		if b != nil && a != nil && *b == *a {
+			continue
+		}
+		drifts = append(drifts, Drift{Target: target, Before: b, After: a})
+	}
+	return drifts
+}
+
+// PrintDrift prints drifted targets as tab-separated lines
+func PrintDrift(drifts []Drift) {
+	describe := func(s *types.TargetSnapshot) string {
+		if s == nil {
+			return "(not planned)"
+		}
+		if s.Readlink != "" {
+			return fmt.Sprintf("%s -> %s", s.Status, s.Readlink)
+		}
+		return string(s.Status)
+	}
+
+	for _, d := range drifts {
+		kind := "CHANGED"
+		switch {
+		case d.Before == nil:
+			kind = "ADDED"
+		case d.After == nil:
+			kind = "REMOVED"
+		}
+		fmt.Printf("%s\t%s\t%s\t=> %s\n", kind, d.Target, describe(d.Before), describe(d.After))
+	}
+}
@@ -0,0 +1,124 @@
+package check
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cdmfs "github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// StaleLink is a symlink into a plan source that the plan does not manage
+type StaleLink struct {
+	Target   string // The symlink
+	Dest     string // Absolute path it points to
+	Dangling bool   // Dest no longer exists
+}
+
+// FindStale walks the given directories without following symlinks and
+// returns the symlinks that point into one of the plan's sources but whose
+// path is not a target of the plan, e.g. leftovers of deleted source files.
+// The sources themselves, VCS metadata and unreadable directories are
+// skipped. Results are sorted by target.
+func FindStale(plan *types.Plan, roots []string) ([]StaleLink, error) {
+	managed := make(map[string]bool, len(plan.Links))
+	for _, link := range plan.Links {
+		managed[cdmfs.PathKey(filepath.Clean(link.Target))] = true
+	}
+
+	var sources []string
+	for _, src := range plan.Sources {
+		if abs, err := filepath.Abs(src); err == nil {
+			sources = append(sources, cdmfs.PathKey(abs))
+		}
+	}
+	inSources := func(dest string) bool {
+		key := cdmfs.PathKey(dest)
+		for _, src := range sources {
+			if strings.HasPrefix(key, src+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+	isSource := func(dir string) bool {
+		key := cdmfs.PathKey(dir)
+		for _, src := range sources {
+			if key == src {
+				return true
+			}
+		}
+		return inSources(dir)
+	}
+
+	var stale []StaleLink
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path %s: %w", root, err)
+		}
+		if _, err := os.Stat(absRoot); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", root, err)
+		}
+
+		err = filepath.WalkDir(absRoot, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				// Relative links inside a source point into it, but are not deployed
+				if isSource(path) || (path != absRoot && isVCSDir(d.Name())) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type()&os.ModeSymlink == 0 || seen[path] {
+				return nil
+			}
+			seen[path] = true
+
+			value, err := os.Readlink(path)
+			if err != nil {
+				return nil
+			}
+			dest := cdmfs.ResolveLinkDest(path, value)
+			if !inSources(dest) || managed[cdmfs.PathKey(path)] {
+				return nil
+			}
+
+			_, statErr := os.Stat(dest)
+			stale = append(stale, StaleLink{Target: path, Dest: dest, Dangling: statErr != nil})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", root, err)
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Target < stale[j].Target })
+	return stale, nil
+}
+
+// isVCSDir reports whether a directory holds version control metadata
+func isVCSDir(name string) bool {
+	return name == ".git" || name == ".hg" || name == ".svn"
+}
+
+// PrintStale prints stale links as tab-separated lines
+func PrintStale(stale []StaleLink) {
+	for _, s := range stale {
+		note := ""
+		if s.Dangling {
+			note = "\t(dangling)"
+		}
+		fmt.Printf("STALE\t%s\t-> %s%s\n", s.Target, s.Dest, note)
+	}
+}
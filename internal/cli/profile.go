@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/spf13/cobra"
+)
+
+// Diagnostic flags, hidden from help
+var (
+	flagCPUProfile string
+	flagMemProfile string
+)
+
+// cpuProfile is the open --cpuprofile file while profiling
+var cpuProfile *os.File
+
+// startProfiling starts the --cpuprofile CPU profile before a command runs
+func startProfiling(cmd *cobra.Command, args []string) error {
+	if flagCPUProfile == "" {
+		return nil
+	}
+	f, err := os.Create(flagCPUProfile)
+	if err != nil {
+		return fmt.Errorf("failed to create CPU profile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to start CPU profile: %w", err)
+	}
+	cpuProfile = f
+	return nil
+}
+
+// stopProfiling stops the CPU profile and writes the --memprofile heap
+// profile. Safe to call more than once.
+func stopProfiling() {
+	if cpuProfile != nil {
+		pprof.StopCPUProfile()
+		cpuProfile.Close()
+		cpuProfile = nil
+	}
+	if flagMemProfile != "" {
+		path := flagMemProfile
+		flagMemProfile = ""
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] Failed to create memory profile: %s\n", err)
+			return
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] Failed to write memory profile: %s\n", err)
+		}
+	}
+}
+
+// exit writes pending profiles and exits with code
+func exit(code int) {
+	stopProfiling()
+	os.Exit(code)
+}
@@ -2,16 +2,30 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/woodgear/cdm/internal/apply"
+	"github.com/woodgear/cdm/internal/bench"
 	"github.com/woodgear/cdm/internal/check"
+	"github.com/woodgear/cdm/internal/config"
+	"github.com/woodgear/cdm/internal/fs"
 	"github.com/woodgear/cdm/internal/plan"
 	"github.com/woodgear/cdm/internal/repo"
+	"github.com/woodgear/cdm/internal/tree"
+	"github.com/woodgear/cdm/internal/watch"
 	"github.com/woodgear/cdm/pkg/types"
 )
 
@@ -23,14 +37,101 @@ var (
 	BuildDate = "unknown"
 
 	// Global flags
-	flagVerbose bool
-	flagDryRun  bool
-	flagBackup  bool
-	flagCdmBase string
-	flagOutput  string
+	flagVerbose          bool
+	flagDryRun           bool
+	flagBackup           bool
+	flagBackupStyle      string
+	flagCdmBase          string
+	flagPrivTool         string
+	flagAllowEmptyGlob   bool
+	flagNoSudo           bool
+	flagRoot             string
+	flagRootHome         bool
+	flagFlat             bool
+	flagModAfter         string
+	flagModBefore        string
+	flagRespectGitignore bool
+	flagHardlink         bool
+	flagSourceConfig     string
+	flagStrict           bool
+	flagTargetMap        string
+	flagAllowExcludeCmd  bool
+	flagStripPrefix      string
+	flagBase             string
+	flagConcurrency      int
+	flagOutput           string
+	flagPlanFile         string
+
+	// Plan-specific flags
+	flagCheckSources bool
+	flagSummaryJSON  bool
+	flagSinceCommit  string
+	flagCompact      bool
+	flagComment      string
+	flagImpact       bool
+	flagEmptyDirs    bool
+	flagNoRemap      bool
+	flagStowReport   bool
+
+	// Apply/deploy-specific flags
+	flagYes           bool
+	flagNoLock        bool
+	flagPrintPlan     bool
+	flagFrozen        bool
+	flagReport        string
+	flagConfirm       bool
+	flagKeepGoing     bool
+	flagDirMode       string
+	flagRequireClean  bool
+	flagTimeout       time.Duration
+	flagRollback      bool
+	flagPlanSHA256    string
+	flagApplyTree     bool
+	flagAllowSystem   bool
+	flagIgnoreMissing bool
+	flagVerifyDryRun  bool
+	flagSetXattrs     bool
+	flagChunkSize     int
+	flagWatch         bool
+	flagWatchDebounce time.Duration
 
 	// Check-specific flags
-	flagIgnoreOK bool
+	flagIgnoreOK          bool
+	flagRepairMissingDirs bool
+	flagTargetOwnerCheck  bool
+	flagResolve           bool
+	flagDereference       bool
+	flagFromSource        bool
+	flagCheckPlan         string
+	flagCheckJSON         bool
+	flagGroupByBase       bool
+	flagParallelCheck     bool
+	flagCheckExport       string
+	flagCompareTo         string
+	flagOverlap           []string
+	flagFollowSources     bool
+	flagStale             bool
+	flagStaleScan         []string
+	flagCountOnly         bool
+	flagCountStatus       []string
+	flagAuditOverwrites   bool
+
+	// Verify-specific flags
+	flagRemote    string
+	flagRemoteCmd string
+
+	// Bench-specific flags
+	flagBenchFiles int
+
+	// Uninstall-specific flags
+	flagOrphansOnly bool
+
+	// Generate-config/apply flags
+	flagForce bool
+
+	// Adopt-specific flags
+	flagAdoptInto   string
+	flagAdoptCommit bool
 )
 
 // rootCmd represents the base command
@@ -59,7 +160,14 @@ Source directories should contain 'home/' and/or 'root/' subdirectories:
 
 If no paths are specified and CDM_BASE is set, paths are auto-discovered:
   - $CDM_BASE/share (common config, low priority)
-  - $CDM_BASE/<hostname> (host-specific config, high priority)`,
+  - $CDM_BASE/<hostname> (host-specific config, high priority; hostgroups.json
+    in CDM_BASE can map several hostnames to one layer directory)
+CDM_LAYERS overrides the layer order, e.g. "share,<os>,<hostname>,local";
+missing layer directories are skipped.
+
+A path may also be a remote git repository, cloned into ~/.cache/cdm:
+  cdm plan git+https://github.com/me/dotfiles
+  cdm plan git+https://github.com/me/dotfiles#v1.2`,
 	RunE: runPlan,
 }
 
@@ -69,7 +177,11 @@ var applyCmd = &cobra.Command{
 	Short: "Apply execution plan",
 	Long: `Apply an execution plan to create symlinks.
 
-If no plan file is specified, uses ./cdm-plan.json by default.`,
+If no plan file is specified, uses --plan-file or ./cdm-plan.json by default.
+Use '-' to read the plan from stdin:
+  cdm plan -o - | cdm apply -
+An http(s) URL is fetched and cached for offline reuse:
+  cdm apply https://config.example.com/plan.json`,
 	RunE: runApply,
 }
 
@@ -79,7 +191,10 @@ var deployCmd = &cobra.Command{
 	Short: "Plan and apply in one step",
 	Long: `Generate and apply an execution plan in one step.
 
-This is equivalent to running 'plan' followed by 'apply'.`,
+This is equivalent to running 'plan' followed by 'apply'.
+
+With --watch, the sources are watched after the first deploy and
+deployed again (debounced) whenever a file in them changes.`,
 	RunE: runDeploy,
 }
 
@@ -91,7 +206,15 @@ var checkCmd = &cobra.Command{
 
 If no paths are specified and CDM_BASE is set, paths are auto-discovered:
   - $CDM_BASE/share (common config, low priority)
-  - $CDM_BASE/<hostname> (host-specific config, high priority)
+  - $CDM_BASE/<hostname> (host-specific config, high priority; hostgroups.json
+    in CDM_BASE can map several hostnames to one layer directory)
+CDM_LAYERS overrides the layer order, e.g. "share,<os>,<hostname>,local";
+missing layer directories are skipped.
+
+By default (--from-source) the plan is regenerated in memory from the
+sources, so no plan file is needed. Use --plan to check a previously
+written plan file instead:
+  cdm check --plan ./cdm-plan.json
 
 Exit codes:
   0 - All links OK
@@ -99,6 +222,124 @@ Exit codes:
 	RunE: runCheck,
 }
 
+// treeCmd represents the tree command
+var treeCmd = &cobra.Command{
+	Use:   "tree [paths...]",
+	Short: "Show planned links as a tree",
+	Long: `Generate a plan and print its targets as an indented tree, grouped
+by base (home/root). Each target is annotated with the source layer
+it comes from and the reason it was included.
+
+If no paths are specified and CDM_BASE is set, paths are auto-discovered:
+  - $CDM_BASE/share (common config, low priority)
+  - $CDM_BASE/<hostname> (host-specific config, high priority; hostgroups.json
+    in CDM_BASE can map several hostnames to one layer directory)
+CDM_LAYERS overrides the layer order, e.g. "share,<os>,<hostname>,local";
+missing layer directories are skipped.`,
+	RunE: runTree,
+}
+
+// uninstallCmd represents the uninstall command
+var uninstallCmd = &cobra.Command{
+	Use:   "uninstall [plan-file]",
+	Short: "Remove links created from a plan",
+	Long: `Remove CDM-owned symlinks listed in an execution plan.
+
+Only targets that are symlinks pointing at their planned source are
+removed; copies and other files are left alone.
+
+With --orphans-only, only links whose source file no longer exists
+(SOURCE_MISSING in check) are removed.
+
+If no plan file is specified, uses --plan-file or ./cdm-plan.json by default.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runUninstall,
+}
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark CDM on a synthetic tree",
+	Long: `Generate a synthetic source tree with N files in a temp dir and time
+plan generation, a dry-run apply and a check over it.
+
+Nothing outside the temp dir is modified. Useful for diagnosing
+performance on large trees.`,
+	Args: cobra.NoArgs,
+	RunE: runBench,
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify --remote user@host [paths...]",
+	Short: "Compare CDM state with a remote system",
+	Long: `Run check locally and 'cdm check --json' on a remote host over SSH,
+then report targets whose status or source differ between the two.
+
+Paths under each system's home directory are compared home-relative,
+so different user names on the two machines do not cause differences.
+Source paths are passed through to the remote check unchanged.
+
+Output lines:
+  DIFF         target differs in status or source
+  LOCAL_ONLY   target only planned locally
+  REMOTE_ONLY  target only planned on the remote
+
+Exit codes:
+  0 - Both systems are identical
+  1 - Differences found`,
+	RunE: runVerify,
+}
+
+// generateConfigCmd represents the generate-config command
+var generateConfigCmd = &cobra.Command{
+	Use:   "generate-config [path]",
+	Short: "Suggest a .cdm.conf.json for a source tree",
+	Long: `Scan a source tree and write a suggested .cdm.conf.json to its root.
+
+The suggestion covers:
+  - exclude: VCS directories, backup/editor temp files, large binaries
+  - linkFolders: plugin manager directories and nested git repositories
+
+The reason for each suggestion is recorded under the "//" key, which
+CDM ignores when loading the config. Review and edit before use.
+
+An existing config is never overwritten without --force.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runGenerateConfig,
+}
+
+// adoptCmd represents the adopt command
+var adoptCmd = &cobra.Command{
+	Use:   "adopt <file>...",
+	Short: "Move existing files into the source tree and link them back",
+	Long: `Move existing files into a source directory and replace each with a
+symlink to its new location (like stow --adopt).
+
+Files under $HOME go to <source>/home/<path relative to $HOME>, other
+files to <source>/root/<absolute path>. The source directory defaults to
+$CDM_BASE/share; use --into for another one (e.g. the host directory).
+
+Only regular files are adopted; symlinks are skipped and directories are
+rejected. An existing file at the destination is never overwritten.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runAdopt,
+}
+
+// explainCmd represents the explain command
+var explainCmd = &cobra.Command{
+	Use:   "explain TARGET [paths...]",
+	Short: "Explain why a target is (or is not) linked",
+	Long: `Generate the plan and trace the decisions that concern one target:
+which source layers provide it, which layer won, and which exclude,
+hidden, gitignore, remap and mapping rules affected it.
+
+Source paths are resolved like plan (auto-discovered from CDM_BASE
+when omitted).`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runExplain,
+}
+
 // repoScanCmd represents the repo-scan command
 var repoScanCmd = &cobra.Command{
 	Use:   "repo-scan [path]",
@@ -112,25 +353,167 @@ Example:
 	Args: cobra.MaximumNArgs(1),
 	RunE: runRepoScan,
 }
+
+// validatePlanCmd represents the validate-plan command
+var validatePlanCmd = &cobra.Command{
+	Use:   "validate-plan [plan-file] [paths...]",
+	Short: "Check that a plan file matches the current sources",
+	Long: `Regenerate a plan from the sources and compare it with a written plan
+file, to catch committed plans that predate source changes.
+
+If no plan file is specified, uses --plan-file or ./cdm-plan.json. Source
+paths are resolved like plan (auto-discovered from CDM_BASE if omitted).
+Links are compared by target, source and action.
+
+Output lines:
+  MISSING   target generated from the sources but not in the plan
+  EXTRA     target in the plan but no longer generated
+  CHANGED   target's source or action differs
+
+Exit codes:
+  0 - Plan matches the sources
+  1 - Plan is out of date`,
+	RunE: runValidatePlan,
+}
+
 func init() {
 	// Global flags
 	rootCmd.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "Verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&flagDryRun, "dry-run", "d", false, "Show what would be done without executing")
 	rootCmd.PersistentFlags().BoolVarP(&flagBackup, "backup", "b", false, "Backup existing files before overwriting")
+	rootCmd.PersistentFlags().StringVar(&flagBackupStyle, "backup-style", fs.BackupStyleSuffix, "Backup naming: suffix (<file>.backup.<time>), tilde (<file>~) or dir (.bak/<file>.<time>)")
 	rootCmd.PersistentFlags().StringVar(&flagCdmBase, "cdm-base", "", "Base configuration directory (overrides CDM_BASE env var)")
+	rootCmd.PersistentFlags().StringVar(&flagRoot, "root", "", "Alternate root directory for the root base (e.g. a chroot at /mnt/rootfs)")
+	rootCmd.PersistentFlags().BoolVar(&flagRootHome, "root-home", false, "With --root, also place home base targets under the alternate root")
+	rootCmd.PersistentFlags().BoolVar(&flagFlat, "flat", false, "Flat source layout: map each source root directly to $HOME")
+	rootCmd.PersistentFlags().StringVar(&flagModAfter, "modified-after", "", "Only include source files modified after this date (YYYY-MM-DD or RFC3339)")
+	rootCmd.PersistentFlags().StringVar(&flagModBefore, "modified-before", "", "Only include source files modified before this date (YYYY-MM-DD or RFC3339)")
+	rootCmd.PersistentFlags().BoolVar(&flagRespectGitignore, "respect-gitignore", false, "Skip source files ignored by the repository's .gitignore files")
+	rootCmd.PersistentFlags().IntVar(&flagConcurrency, "concurrency", runtime.NumCPU(), "Maximum concurrent workers for parallelized work (check --parallel-check, excludeCmd predicates); 1 disables concurrency")
+	rootCmd.PersistentFlags().StringVar(&flagPlanFile, "plan-file", "", "Plan file used by plan (-o), apply, uninstall and check (--plan); a positional plan file or the command's own flag overrides it")
+	rootCmd.PersistentFlags().StringVar(&flagBase, "base", plan.BaseAll, "Only operate on targets of one base: home ($HOME), root (system paths) or all")
+	rootCmd.PersistentFlags().StringVar(&flagStripPrefix, "strip-prefix", "", "Directory inside each source that contains the home/root bases (e.g. dotfiles)")
+	rootCmd.PersistentFlags().StringVar(&flagSourceConfig, "source-config", "", "Config file merged into the root .cdm.conf.json of every source, for sources that cannot hold one")
+	rootCmd.PersistentFlags().StringVar(&flagTargetMap, "target-map", "", "JSON file of {\"<source-relative path>\": \"<target>\"} overrides applied after pathMappings")
+	rootCmd.PersistentFlags().BoolVar(&flagAllowExcludeCmd, "allow-exclude-cmd", false, "Run the excludeCmd predicates of source configs (also CDM_ALLOW_EXCLUDE_CMD); without it, configs with excludeCmd are refused")
+	rootCmd.PersistentFlags().BoolVar(&flagStrict, "strict", false, "Fail when a source path cannot be read instead of warning and planning the rest")
+	rootCmd.PersistentFlags().BoolVar(&flagHardlink, "hardlink", false, "Plan hard links instead of symlinks for files (same filesystem only)")
+	rootCmd.PersistentFlags().BoolVar(&flagAllowEmptyGlob, "allow-empty-glob", false, "Don't fail when a source path glob matches nothing")
+	rootCmd.PersistentFlags().StringVar(&flagPrivTool, "privilege-tool", "sudo", "Tool for privileged operations: sudo, doas or none")
+	rootCmd.PersistentFlags().BoolVar(&flagNoSudo, "no-sudo", false, "Never escalate privileges; fail with a permission error instead (also CDM_NO_SUDO)")
+	rootCmd.PersistentFlags().StringVar(&flagCPUProfile, "cpuprofile", "", "Write a CPU profile to this file (pprof format)")
+	rootCmd.PersistentFlags().StringVar(&flagMemProfile, "memprofile", "", "Write a heap profile to this file on exit (pprof format)")
+	rootCmd.PersistentFlags().MarkHidden("cpuprofile")
+	rootCmd.PersistentFlags().MarkHidden("memprofile")
+	rootCmd.PersistentPreRunE = startProfiling
 
 	// Plan-specific flags
-	planCmd.Flags().StringVarP(&flagOutput, "output", "o", "./cdm-plan.json", "Output plan file")
+	planCmd.Flags().StringVarP(&flagOutput, "output", "o", "./cdm-plan.json", "Output plan file ('-' for stdout)")
+	planCmd.Flags().StringVar(&flagComment, "comment", "", "Attach a human annotation to the plan")
+	planCmd.Flags().StringVar(&flagSinceCommit, "since-commit", "", "Only plan files changed since this git ref (git diff --name-only REF in each source)")
+	planCmd.Flags().BoolVar(&flagCompact, "compact", false, "Write the plan as compact single-line JSON")
+	planCmd.Flags().BoolVar(&flagSummaryJSON, "summary-json", false, "Print only the plan stats and duration as JSON to stdout")
+	planCmd.Flags().BoolVar(&flagEmptyDirs, "include-empty-dirs", false, "Plan mkdir entries for empty source directories so the target structure mirrors the source")
+	planCmd.Flags().BoolVar(&flagStowReport, "stow-report", false, "Print the planned links grouped by source in the style of GNU Stow's verbose output")
+	planCmd.Flags().BoolVar(&flagImpact, "impact", false, "Report links the plan would create, change or remove compared with the last applied plan, flagging currently-OK ones")
+	planCmd.Flags().BoolVar(&flagNoRemap, "no-remap", false, "Ignore pathMappings, to compare the raw plan with the remapped one")
+	deployCmd.Flags().BoolVar(&flagNoRemap, "no-remap", false, "Ignore pathMappings, to compare the raw plan with the remapped one")
+	explainCmd.Flags().BoolVar(&flagNoRemap, "no-remap", false, "Ignore pathMappings, to see whether a remap rule causes the result")
+	planCmd.Flags().BoolVar(&flagCheckSources, "check-sources", false, "Verify every link source exists and is readable before writing the plan")
+
+	// Apply/deploy-specific flags
+	applyCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Apply links from requireConfirm sources without prompting")
+	deployCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Apply links from requireConfirm sources without prompting")
+	applyCmd.Flags().BoolVar(&flagNoLock, "no-lock", false, "Don't take the exclusive apply lock")
+	deployCmd.Flags().BoolVar(&flagNoLock, "no-lock", false, "Don't take the exclusive apply lock")
+	applyCmd.Flags().BoolVar(&flagPrintPlan, "print-plan", false, "Print the plan's links before applying (implied by --dry-run)")
+	deployCmd.Flags().BoolVar(&flagPrintPlan, "print-plan", false, "Print the plan's links before applying (implied by --dry-run)")
+	applyCmd.Flags().StringVar(&flagReport, "report", "", "Write a JSON record of the apply result to this file")
+	deployCmd.Flags().StringVar(&flagReport, "report", "", "Write a JSON record of the apply result to this file")
+	applyCmd.Flags().BoolVar(&flagConfirm, "confirm", false, "Show a summary of creates/overwrites/removes and prompt before applying")
+	deployCmd.Flags().BoolVar(&flagConfirm, "confirm", false, "Show a summary of creates/overwrites/removes and prompt before applying")
+	applyCmd.Flags().BoolVar(&flagFrozen, "frozen", false, "Fail instead of removing or overwriting any existing target")
+	applyCmd.Flags().BoolVar(&flagForce, "force", false, "Replace directories that block file targets (moved aside as timestamped backups)")
+	deployCmd.Flags().BoolVar(&flagForce, "force", false, "Replace directories that block file targets (moved aside as timestamped backups)")
+	applyCmd.Flags().BoolVar(&flagKeepGoing, "keep-going", false, "Continue after a link fails instead of stopping at the first failure")
+	deployCmd.Flags().BoolVar(&flagKeepGoing, "keep-going", false, "Continue after a link fails instead of stopping at the first failure")
+	applyCmd.Flags().StringVar(&flagDirMode, "dir-mode", "", "Octal mode for created parent directories (default 755; dirPermissions config overrides per subtree)")
+	deployCmd.Flags().StringVar(&flagDirMode, "dir-mode", "", "Octal mode for created parent directories (default 755; dirPermissions config overrides per subtree)")
+	deployCmd.Flags().BoolVar(&flagFrozen, "frozen", false, "Fail instead of removing or overwriting any existing target")
+	applyCmd.Flags().DurationVar(&flagTimeout, "timeout", 0, "Kill hooks and sudo commands running longer than this (default: none on a terminal, 10m otherwise)")
+	deployCmd.Flags().DurationVar(&flagTimeout, "timeout", 0, "Kill hooks and sudo commands running longer than this (default: none on a terminal, 10m otherwise)")
+	applyCmd.Flags().BoolVar(&flagRequireClean, "require-clean", false, "Refuse to apply if a git-backed source has uncommitted changes")
+	deployCmd.Flags().BoolVar(&flagRequireClean, "require-clean", false, "Refuse to deploy if a git-backed source has uncommitted changes")
+	applyCmd.Flags().BoolVar(&flagApplyTree, "tree", false, "With --dry-run, preview the resulting targets as a tree annotated with what would change")
+	applyCmd.Flags().StringVar(&flagPlanSHA256, "sha256", "", "Expected SHA-256 of a plan fetched from an http(s) URL")
+	applyCmd.Flags().BoolVar(&flagAllowSystem, "yes-i-understand-root", false, "Change system paths (/etc, /usr, ...) without the interactive confirmation")
+	deployCmd.Flags().BoolVar(&flagAllowSystem, "yes-i-understand-root", false, "Change system paths (/etc, /usr, ...) without the interactive confirmation")
+	applyCmd.Flags().BoolVar(&flagIgnoreMissing, "ignore-source-missing", true, "Skip links whose source is missing with a warning; false makes them failed links")
+	deployCmd.Flags().BoolVar(&flagIgnoreMissing, "ignore-source-missing", true, "Skip links whose source is missing with a warning; false makes them failed links")
+	applyCmd.Flags().IntVar(&flagChunkSize, "chunk-size", 0, "Stream the plan file and apply its links this many at a time instead of loading the whole plan (0 loads it at once)")
+	applyCmd.Flags().BoolVar(&flagVerifyDryRun, "verify-dry-run", false, "Check each link's dry-run classification against what the real apply did and report discrepancies")
+	deployCmd.Flags().BoolVar(&flagVerifyDryRun, "verify-dry-run", false, "Check each link's dry-run classification against what the real apply did and report discrepancies")
+	applyCmd.Flags().BoolVar(&flagSetXattrs, "set-xattrs", false, "Set the extended attributes from the xattrs config (e.g. SELinux contexts) on targets after linking")
+	deployCmd.Flags().BoolVar(&flagSetXattrs, "set-xattrs", false, "Set the extended attributes from the xattrs config (e.g. SELinux contexts) on targets after linking")
+	deployCmd.Flags().BoolVar(&flagRollback, "rollback-on-check-failure", false, "Check the applied links after deploying and revert them if any is not OK")
+	deployCmd.Flags().BoolVar(&flagWatch, "watch", false, "Keep watching the sources and deploy again whenever they change (Ctrl-C to stop)")
+	deployCmd.Flags().DurationVar(&flagWatchDebounce, "watch-debounce", 300*time.Millisecond, "With --watch, wait for changes to settle this long before deploying again")
 
 	// Check-specific flags
 	checkCmd.Flags().BoolVar(&flagIgnoreOK, "ignore-ok", false, "Hide OK status entries")
+	checkCmd.Flags().BoolVar(&flagResolve, "resolve", false, "Show the fully resolved real path of each target")
+	checkCmd.Flags().BoolVar(&flagDereference, "dereference", false, "Verify OK links resolve to a readable, non-empty regular file")
+	checkCmd.Flags().BoolVar(&flagTargetOwnerCheck, "target-owner-check", false, "Verify target uid/gid against ownership config")
+	checkCmd.Flags().BoolVar(&flagFromSource, "from-source", true, "Regenerate the plan from the sources in memory (default)")
+	checkCmd.Flags().StringVar(&flagCheckPlan, "plan", "", "Check a plan file instead of regenerating from sources ('-' for stdin)")
+	checkCmd.Flags().StringVar(&flagCheckExport, "export", "", "Write a JSON snapshot of every target's status and symlink value to this file")
+	checkCmd.Flags().StringVar(&flagCompareTo, "compare-to", "", "Report targets that changed since a snapshot written by --export")
+	checkCmd.Flags().BoolVar(&flagParallelCheck, "parallel-check", false, "Check links concurrently (--concurrency workers, default one per CPU)")
+	checkCmd.Flags().BoolVar(&flagGroupByBase, "group-by-base", false, "Group results into home and root (system, needs sudo) sections with subtotals")
+	checkCmd.Flags().BoolVar(&flagAuditOverwrites, "audit-overwrites", false, "List every real file that past applies replaced, with the hash of its content and its backup")
+	checkCmd.Flags().BoolVar(&flagCheckJSON, "json", false, "Print the link check report as JSON (repos are not checked)")
+	checkCmd.Flags().BoolVar(&flagFollowSources, "follow-source-symlinks", false, "Accept links whose target and source resolve (EvalSymlinks) to the same file")
+	checkCmd.Flags().BoolVar(&flagStale, "stale", false, "Report symlinks into the plan's sources that the plan does not manage (leftovers of deleted files)")
+	checkCmd.Flags().StringSliceVar(&flagStaleScan, "scan", nil, "Directories searched by --stale (comma-separated or repeated; default $HOME)")
+	checkCmd.Flags().StringSliceVar(&flagOverlap, "overlap", nil, "Report targets claimed by more than one of these plan files (comma-separated or repeated)")
+	checkCmd.Flags().BoolVar(&flagCountOnly, "count-only", false, "Print only the number of non-OK links (exit code still reflects health)")
+	checkCmd.Flags().StringSliceVar(&flagCountStatus, "count-status", nil, "Like --count-only, but count links with these statuses (e.g. MISSING; comma-separated or repeated)")
+	checkCmd.Flags().BoolVar(&flagRepairMissingDirs, "repair-missing-dirs", false, "Create missing parent directories of targets")
+
+	// Verify-specific flags
+	verifyCmd.Flags().StringVar(&flagRemote, "remote", "", "SSH destination to compare against (user@host)")
+	verifyCmd.Flags().StringVar(&flagRemoteCmd, "remote-cmd", "cdm", "cdm command on the remote host")
+	verifyCmd.MarkFlagRequired("remote")
+
+	// Bench-specific flags
+	benchCmd.Flags().IntVar(&flagBenchFiles, "files", 1000, "Number of files in the synthetic tree")
+
+	// Uninstall-specific flags
+	uninstallCmd.Flags().BoolVar(&flagOrphansOnly, "orphans-only", false, "Only remove links whose source no longer exists")
+	uninstallCmd.Flags().BoolVar(&flagAllowSystem, "yes-i-understand-root", false, "Remove links in system paths (/etc, /usr, ...) without the interactive confirmation")
+
+	// Generate-config-specific flags
+	generateConfigCmd.Flags().BoolVar(&flagForce, "force", false, "Overwrite an existing .cdm.conf.json")
+
+	// Adopt-specific flags
+	adoptCmd.Flags().StringVar(&flagAdoptInto, "into", "", "Source directory to adopt into (default: $CDM_BASE/share)")
+	adoptCmd.Flags().BoolVar(&flagAdoptCommit, "commit", false, "Commit the adopted files in the source repository")
+	adoptCmd.Flags().BoolVar(&flagAllowSystem, "yes-i-understand-root", false, "Adopt files in system paths (/etc, /usr, ...) without the interactive confirmation")
 
 	// Add commands
 	rootCmd.AddCommand(planCmd)
 	rootCmd.AddCommand(applyCmd)
 	rootCmd.AddCommand(deployCmd)
 	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(treeCmd)
 	rootCmd.AddCommand(repoScanCmd)
+	rootCmd.AddCommand(benchCmd)
+	rootCmd.AddCommand(uninstallCmd)
+	rootCmd.AddCommand(generateConfigCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(adoptCmd)
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(validatePlanCmd)
 
 	// Completion command
 	completionCmd := &cobra.Command{
@@ -190,6 +573,7 @@ Load completions:
 
 // Execute runs the CLI
 func Execute() error {
+	defer stopProfiling()
 	return rootCmd.Execute()
 }
 
@@ -201,7 +585,9 @@ func getCdmBase() string {
 	return os.Getenv("CDM_BASE")
 }
 
-// getAutoDiscoverPaths returns auto-discovered paths based on CDM_BASE
+// getAutoDiscoverPaths returns the existing CDM_BASE layer directories
+// named by the CDM_LAYERS template (default "share,<hostname>"), lowest
+// precedence first
 func getAutoDiscoverPaths() ([]string, error) {
 	cdmBase := getCdmBase()
 	if cdmBase == "" {
@@ -213,16 +599,82 @@ func getAutoDiscoverPaths() ([]string, error) {
 		return nil, fmt.Errorf("failed to get hostname: %w", err)
 	}
 
-	sharePath := filepath.Join(cdmBase, "share")
-	hostnamePath := filepath.Join(cdmBase, hostname)
+	layer, err := config.HostLayer(cdmBase, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if flagVerbose && layer != hostname {
+		fmt.Printf("[INFO] Host %s uses layer %s (%s)\n", hostname, layer, config.HostGroupsFileName)
+	}
+
+	template := os.Getenv(config.LayersEnv)
+	if template == "" {
+		template = config.DefaultLayers
+	}
+	layers, err := config.ExpandLayers(template, layer)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, name := range layers {
+		layerPath := filepath.Join(cdmBase, name)
+		if info, err := os.Stat(layerPath); err != nil || !info.IsDir() {
+			if flagVerbose {
+				fmt.Printf("[SKIP] Layer not found: %s\n", layerPath)
+			}
+			continue
+		}
+		paths = append(paths, layerPath)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("none of the layers %s exist in CDM_BASE %s", strings.Join(layers, ", "), cdmBase)
+	}
+	return paths, nil
+}
+
+// expandGlobs expands glob patterns in source path arguments.
+// Matches of a pattern are sorted alphabetically and inserted in place,
+// so precedence follows argument order, then alphabetical order.
+func expandGlobs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if repo.IsGitSource(arg) || !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
 
-	return []string{sharePath, hostnamePath}, nil
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %s: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			if !flagAllowEmptyGlob {
+				return nil, fmt.Errorf("glob pattern matched nothing: %s (use --allow-empty-glob to ignore)", arg)
+			}
+			if flagVerbose {
+				fmt.Printf("[SKIP] Glob matched nothing: %s\n", arg)
+			}
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
 }
 
-// getSourcePaths returns source paths from args or auto-discovery
+// getSourcePaths returns source paths from args or auto-discovery.
+// Glob patterns are expanded and git+ source specs are resolved to
+// local cached clones.
 func getSourcePaths(args []string) ([]string, error) {
 	if len(args) > 0 {
-		return args, nil
+		paths, err := expandGlobs(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no source paths left after glob expansion")
+		}
+		return repo.NewManager(flagVerbose).ResolveSources(paths)
 	}
 
 	paths, err := getAutoDiscoverPaths()
@@ -237,135 +689,728 @@ func getSourcePaths(args []string) ([]string, error) {
 	return paths, nil
 }
 
+// noSudo reports whether privilege escalation is disabled by flag or env
+func noSudo() bool {
+	if flagNoSudo {
+		return true
+	}
+	v, err := strconv.ParseBool(os.Getenv("CDM_NO_SUDO"))
+	return err == nil && v
+}
+
+// getPrivilegeTool returns the privilege tool, honouring --no-sudo
+func getPrivilegeTool() string {
+	if noSudo() {
+		return fs.PrivilegeNone
+	}
+	return flagPrivTool
+}
+
+// warnSudoLinks warns about links targeting system paths that will need
+// privilege escalation, so the user can decide before applying
+func warnSudoLinks(p *types.Plan) {
+	if fs.IsRoot() {
+		return
+	}
+
+	var targets []string
+	for _, link := range p.Links {
+		if fs.NeedsSudo(link.Target) {
+			targets = append(targets, link.Target)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "[WARN] %d links target system paths and will need %s:\n", len(targets), getPrivilegeTool())
+	for _, target := range targets {
+		fmt.Fprintf(os.Stderr, "  %s\n", target)
+	}
+}
+
+// parseDate parses a YYYY-MM-DD (local time) or RFC3339 date flag
+func parseDate(flag, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s %q: expected YYYY-MM-DD or RFC3339", flag, value)
+	}
+	return t, nil
+}
+
+// newGenerator creates a plan generator configured from the command-line flags
+func newGenerator() (*plan.Generator, error) {
+	modAfter, err := parseDate("modified-after", flagModAfter)
+	if err != nil {
+		return nil, err
+	}
+	modBefore, err := parseDate("modified-before", flagModBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	stripPrefix := filepath.Clean(flagStripPrefix)
+	if flagStripPrefix == "" {
+		stripPrefix = ""
+	} else if filepath.IsAbs(stripPrefix) || stripPrefix == ".." || strings.HasPrefix(stripPrefix, "../") {
+		return nil, fmt.Errorf("invalid --strip-prefix %q: must be a path inside the source", flagStripPrefix)
+	}
+
+	base, err := getBase()
+	if err != nil {
+		return nil, err
+	}
+
+	generator := plan.NewGenerator(flagVerbose)
+	generator.SetOptions(types.PlanOptions{
+		Root:             flagRoot,
+		RootHome:         flagRootHome,
+		Flat:             flagFlat,
+		ModifiedAfter:    modAfter,
+		ModifiedBefore:   modBefore,
+		RespectGitignore: flagRespectGitignore,
+		SinceCommit:      flagSinceCommit,
+		Hardlink:         flagHardlink,
+		StripPrefix:      stripPrefix,
+		Base:             base,
+		IncludeEmptyDirs: flagEmptyDirs,
+		Concurrency:      flagConcurrency,
+		NoRemap:          flagNoRemap,
+		SourceConfig:     flagSourceConfig,
+		Strict:           flagStrict,
+		TargetMap:        flagTargetMap,
+		AllowExcludeCmd:  allowExcludeCmd(),
+		Timeout:          flagTimeout,
+	})
+	return generator, nil
+}
+
+// allowExcludeCmd reports whether excludeCmd predicates may run, by flag or env
+func allowExcludeCmd() bool {
+	if flagAllowExcludeCmd {
+		return true
+	}
+	v, err := strconv.ParseBool(os.Getenv("CDM_ALLOW_EXCLUDE_CMD"))
+	return err == nil && v
+}
+
+// getBase validates --base, returning "" when all bases are selected
+func getBase() (string, error) {
+	switch flagBase {
+	case plan.BaseHome, plan.BaseRoot:
+		return flagBase, nil
+	case plan.BaseAll, "":
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid --base %q: expected home, root or all", flagBase)
+}
+
+// filterBase drops the links of a plan read from a file whose targets are
+// outside the --base selection
+func filterBase(p *types.Plan) error {
+	base, err := getBase()
+	if err != nil || base == "" {
+		return err
+	}
+
+	kept := p.Links[:0]
+	for _, link := range p.Links {
+		if plan.InBase(link.Target, base) {
+			kept = append(kept, link)
+		}
+	}
+	if flagVerbose && len(kept) < len(p.Links) {
+		fmt.Printf("[INFO] --base %s: %d of %d links selected\n", base, len(kept), len(p.Links))
+	}
+	p.Links = kept
+	return nil
+}
+
+// getApplyOptions builds apply options from the command-line flags
+func getApplyOptions() types.ApplyOptions {
+	return types.ApplyOptions{
+		DryRun:        flagDryRun,
+		Backup:        flagBackup,
+		BackupStyle:   flagBackupStyle,
+		Verbose:       flagVerbose,
+		Yes:           flagYes,
+		NoLock:        flagNoLock,
+		Frozen:        flagFrozen,
+		Force:         flagForce,
+		KeepGoing:     flagKeepGoing,
+		DirMode:       flagDirMode,
+		Confirm:       flagConfirm,
+		PrivilegeTool: getPrivilegeTool(),
+		Report:        flagReport,
+		AllowSystem:   flagAllowSystem,
+		FailMissing:   !flagIgnoreMissing,
+		VerifyDryRun:  flagVerifyDryRun,
+		SetXattrs:     flagSetXattrs,
+	}
+}
+
 func runPlan(cmd *cobra.Command, args []string) error {
+	if flagPlanFile != "" && !cmd.Flags().Changed("output") {
+		flagOutput = flagPlanFile
+	}
+
 	// Get source paths
 	sourcePaths, err := getSourcePaths(args)
 	if err != nil {
 		return err
 	}
 
+	if flagSummaryJSON && flagOutput == apply.StdioPlan {
+		return fmt.Errorf("--summary-json cannot be combined with -o -: both write to stdout")
+	}
+	if flagImpact && (flagSummaryJSON || flagOutput == apply.StdioPlan) {
+		return fmt.Errorf("--impact cannot be combined with --summary-json or -o -")
+	}
+	if flagStowReport && (flagSummaryJSON || flagOutput == apply.StdioPlan) {
+		return fmt.Errorf("--stow-report cannot be combined with --summary-json or -o -")
+	}
+
 	// Generate plan
-	generator := plan.NewGenerator(flagVerbose)
+	generator, err := newGenerator()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
 	p, err := generator.Generate(sourcePaths)
 	if err != nil {
 		return fmt.Errorf("failed to generate plan: %w", err)
 	}
+	duration := time.Since(start)
+	p.Comment = flagComment
+
+	warnSudoLinks(p)
+
+	// Re-verify sources right before writing
+	if flagCheckSources {
+		if problems := plan.CheckSources(p); len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Printf("[ERROR] %s\n", problem)
+			}
+			return fmt.Errorf("%d link sources are missing or unreadable", len(problems))
+		}
+	}
 
 	// Write plan to file
-	if err := apply.WritePlan(flagOutput, p); err != nil {
+	writePlan := apply.WritePlan
+	if flagCompact {
+		writePlan = apply.WritePlanCompact
+	}
+	if err := writePlan(flagOutput, p); err != nil {
 		return fmt.Errorf("failed to write plan: %w", err)
 	}
 
+	// Keep stdout clean for the plan itself when piping
+	if flagOutput == apply.StdioPlan {
+		fmt.Fprintf(os.Stderr, "[SUCCESS] Plan generated: %d links\n", p.Stats.Total)
+		return nil
+	}
+
+	if flagSummaryJSON {
+		data, err := json.Marshal(types.PlanSummary{Stats: p.Stats, DurationMs: duration.Milliseconds()})
+		if err != nil {
+			return fmt.Errorf("failed to marshal summary: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
 	fmt.Printf("[SUCCESS] Plan generated: %s\n", flagOutput)
 	fmt.Printf("  Total files: %d\n", p.Stats.Total)
 	fmt.Printf("  New: %d\n", p.Stats.New)
 	fmt.Printf("  Override: %d\n", p.Stats.Override)
+	fmt.Printf("  Skip: %d\n", p.Stats.Skip)
 
 	if flagVerbose {
-		fmt.Println("\n[INFO] Plan preview:")
-		data, _ := apply.ReadPlan(flagOutput)
-		for _, link := range data.Links {
-			fmt.Printf("  %s -> %s (%s)\n", link.Target, link.Source, link.Reason)
-		}
+		fmt.Println()
+		apply.PrintPlan(p)
 	}
 
+	if flagStowReport {
+		fmt.Println()
+		apply.PrintStowReport(p)
+	}
+
+	if flagImpact {
+		return printImpact(p)
+	}
+
+	return nil
+}
+
+// printImpact reports what applying p would change relative to the last
+// applied plan
+func printImpact(p *types.Plan) error {
+	prev, err := apply.LoadLastPlan()
+	if err != nil {
+		return fmt.Errorf("failed to load last applied plan: %w", err)
+	}
+
+	fmt.Println()
+	if prev == nil {
+		fmt.Println("[WARN] No plan has been applied yet; reporting every link not already in place as new")
+	} else {
+		fmt.Printf("[INFO] Impact against the last applied plan (%d links):\n", len(prev.Links))
+	}
+	check.PrintImpact(newChecker().Impact(prev, p))
 	return nil
 }
 
 func runApply(cmd *cobra.Command, args []string) error {
-	planFile := "./cdm-plan.json"
-	if len(args) > 0 {
-		planFile = args[0]
+	if err := fs.ValidateBackupStyle(flagBackupStyle); err != nil {
+		return err
+	}
+	if err := fs.ValidatePrivilegeTool(flagPrivTool); err != nil {
+		return err
+	}
+	if flagVerifyDryRun && flagDryRun {
+		return fmt.Errorf("--verify-dry-run checks a real apply and cannot be combined with --dry-run")
+	}
+
+	planFile := resolvePlanFile(args)
+
+	if flagApplyTree && !flagDryRun {
+		return fmt.Errorf("--tree requires --dry-run")
+	}
+	if flagPlanSHA256 != "" && !apply.IsRemotePlan(planFile) {
+		return fmt.Errorf("--sha256 only applies to plans fetched from an http(s) URL")
+	}
+
+	// Fetch remote plans into the local cache
+	if apply.IsRemotePlan(planFile) {
+		cached, err := apply.FetchPlan(planFile, flagPlanSHA256)
+		if err != nil {
+			return err
+		}
+		planFile = cached
+	}
+
+	// Check if plan file exists ("-" reads from stdin)
+	if planFile != apply.StdioPlan {
+		if _, err := os.Stat(planFile); os.IsNotExist(err) {
+			return fmt.Errorf("plan file not found: %s", planFile)
+		}
+	}
+
+	if flagChunkSize != 0 {
+		return applyStream(cmd, planFile)
+	}
+
+	p, err := apply.ReadPlan(planFile)
+	if err != nil {
+		return err
+	}
+	if err := filterBase(p); err != nil {
+		return err
+	}
+
+	if flagRequireClean {
+		if err := requireCleanSources(p.Sources); err != nil {
+			return err
+		}
+	}
+
+	if flagApplyTree {
+		apply.PrintPreviewTree(p, getApplyOptions())
+		return nil
 	}
 
-	// Check if plan file exists
-	if _, err := os.Stat(planFile); os.IsNotExist(err) {
-		return fmt.Errorf("plan file not found: %s", planFile)
+	if flagPrintPlan || flagDryRun {
+		apply.PrintPlan(p)
 	}
 
 	// Apply plan
 	applier := apply.NewApplier(flagVerbose)
-	opts := types.ApplyOptions{
-		DryRun:  flagDryRun,
-		Backup:  flagBackup,
-		Verbose: flagVerbose,
+	opts := getApplyOptions()
+	opts.Timeout = applyTimeout(cmd)
+
+	return applier.Apply(p, opts)
+}
+
+// applyStream applies a plan file in chunks of --chunk-size links without
+// loading it as a whole
+func applyStream(cmd *cobra.Command, planFile string) error {
+	if flagApplyTree || flagPrintPlan {
+		return fmt.Errorf("--tree and --print-plan need the whole plan and cannot be combined with --chunk-size")
+	}
+
+	if flagRequireClean {
+		header, err := apply.ReadPlanHeader(planFile)
+		if err != nil {
+			return err
+		}
+		if err := requireCleanSources(header.Sources); err != nil {
+			return err
+		}
+	}
+
+	base, err := getBase()
+	if err != nil {
+		return err
+	}
+	var keep func(types.Link) bool
+	if base != "" {
+		keep = func(link types.Link) bool { return plan.InBase(link.Target, base) }
 	}
 
-	return applier.ApplyFromFile(planFile, opts)
+	applier := apply.NewApplier(flagVerbose)
+	opts := getApplyOptions()
+	opts.Timeout = applyTimeout(cmd)
+
+	return applier.ApplyStream(planFile, flagChunkSize, keep, opts)
 }
 
 func runDeploy(cmd *cobra.Command, args []string) error {
+	if err := fs.ValidateBackupStyle(flagBackupStyle); err != nil {
+		return err
+	}
+	if err := fs.ValidatePrivilegeTool(flagPrivTool); err != nil {
+		return err
+	}
+	if flagVerifyDryRun && flagDryRun {
+		return fmt.Errorf("--verify-dry-run checks a real apply and cannot be combined with --dry-run")
+	}
+
 	// Get source paths
 	sourcePaths, err := getSourcePaths(args)
 	if err != nil {
 		return err
 	}
 
-	// Generate temporary plan
-	tmpPlan := fmt.Sprintf("/tmp/cdm-deploy-%d.json", os.Getpid())
-	defer os.Remove(tmpPlan)
+	if flagRequireClean {
+		if err := requireCleanSources(sourcePaths); err != nil {
+			return err
+		}
+	}
+
+	if flagWatch {
+		return watchDeploy(cmd, sourcePaths)
+	}
 
 	// Generate plan
-	generator := plan.NewGenerator(flagVerbose)
+	generator, err := newGenerator()
+	if err != nil {
+		return err
+	}
 	p, err := generator.Generate(sourcePaths)
 	if err != nil {
 		return fmt.Errorf("failed to generate plan: %w", err)
 	}
 
+	if err := deployLinks(cmd, p); err != nil {
+		return err
+	}
+	deployRepos(p)
+	return nil
+}
+
+// deployLinks writes the plan to the state dir and applies its links
+func deployLinks(cmd *cobra.Command, p *types.Plan) error {
+	stateDir, err := config.EnsureStateDir()
+	if err != nil {
+		return err
+	}
+	tmpPlan := filepath.Join(stateDir, fmt.Sprintf("deploy-%d.json", os.Getpid()))
+	defer os.Remove(tmpPlan)
+
 	// Write plan
 	if err := apply.WritePlan(tmpPlan, p); err != nil {
 		return fmt.Errorf("failed to write plan: %w", err)
 	}
 
-	// Apply plan (symlinks)
-	applier := apply.NewApplier(flagVerbose)
-	opts := types.ApplyOptions{
-		DryRun:  flagDryRun,
-		Backup:  flagBackup,
-		Verbose: flagVerbose,
+	if flagPrintPlan || flagDryRun {
+		apply.PrintPlan(p)
 	}
 
-	if err := applier.Apply(p, opts); err != nil {
-		return err
-	}
+	// Apply plan (symlinks)
+	applier := apply.NewApplier(flagVerbose)
+	opts := getApplyOptions()
+	opts.Timeout = applyTimeout(cmd)
 
-	// Deploy repos
-	if len(p.Repos) > 0 {
-		fmt.Printf("\n[INFO] Deploying %d repos...\n", len(p.Repos))
-		manager := repo.NewManager(flagVerbose)
-		for _, r := range p.Repos {
-			result := manager.DeployRepo(r.Path, r, flagDryRun)
-			printRepoResult(result)
+	applyErr := applier.Apply(p, opts)
+	if flagRollback && !flagDryRun {
+		if err := verifyDeploy(applier, p, applyErr, opts); err != nil {
+			return err
 		}
 	}
+	return applyErr
+}
 
-	return nil
+// deployRepos clones or updates the repos of the plan
+func deployRepos(p *types.Plan) {
+	if len(p.Repos) == 0 {
+		return
+	}
+	fmt.Printf("\n[INFO] Deploying %d repos...\n", len(p.Repos))
+	manager := repo.NewManager(flagVerbose)
+	for _, r := range p.Repos {
+		result := manager.DeployRepo(r.Path, r, flagDryRun)
+		printRepoResult(result)
+	}
 }
 
-func runCheck(cmd *cobra.Command, args []string) error {
-	// Get source paths (same pattern as plan/deploy)
-	sourcePaths, err := getSourcePaths(args)
+// watchDeploy deploys the sources, then watches them and deploys again after
+// each batch of changes until interrupted. Failed deploys are reported and
+// watching continues, so a broken edit can be fixed in place.
+func watchDeploy(cmd *cobra.Command, sourcePaths []string) error {
+	generator, err := newGenerator()
 	if err != nil {
 		return err
 	}
 
-	// Generate plan (like deploy)
-	generator := plan.NewGenerator(flagVerbose)
-	p, err := generator.Generate(sourcePaths)
+	var last *types.Plan
+	deploy := func(changed []string) {
+		p, err := generator.Generate(sourcePaths)
+		if err != nil {
+			fmt.Printf("[ERROR] failed to generate plan: %s\n", err)
+			return
+		}
+		if last != nil {
+			affected := changedLinks(last, p, changed)
+			if len(affected) == 0 && reflect.DeepEqual(last.Repos, p.Repos) {
+				if flagVerbose {
+					fmt.Printf("[WATCH] %d files changed, no links affected\n", len(changed))
+				}
+				return
+			}
+			fmt.Printf("\n[WATCH] %d files changed, %d links affected; redeploying the plan\n", len(changed), len(affected))
+			if flagVerbose {
+				for _, link := range affected {
+					fmt.Printf("  %s -> %s (%s)\n", link.Target, link.Source, link.Action)
+				}
+			}
+		}
+		// The whole plan is applied so the saved last plan stays complete;
+		// links that did not change are classified as up to date and skipped
+		if err := deployLinks(cmd, p); err != nil {
+			fmt.Printf("[ERROR] %s\n", err)
+			return
+		}
+		if last == nil || !reflect.DeepEqual(last.Repos, p.Repos) {
+			deployRepos(p)
+		}
+		last = p
+	}
+	deploy(nil)
+
+	w, err := watch.New(sourcePaths, flagVerbose)
 	if err != nil {
-		return fmt.Errorf("failed to generate plan: %w", err)
+		return err
 	}
+	defer w.Close()
 
-	allOK := true
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Check symlinks
-	if len(p.Links) > 0 {
-		checker := check.NewChecker(flagVerbose)
-		report := checker.CheckPlan(p)
-		check.PrintReport(report, flagVerbose, flagIgnoreOK)
-		if !report.AllOK {
+	fmt.Printf("\n[INFO] Watching %d source paths for changes (Ctrl-C to stop)\n", len(sourcePaths))
+	err = w.Run(ctx, flagWatchDebounce, deploy)
+	fmt.Printf("[INFO] Stopped watching\n")
+	return err
+}
+
+// changedLinks returns the links of the regenerated plan that are new or
+// changed since the last deployed one, plus copies and hard links whose
+// source file changed on disk
+func changedLinks(last, p *types.Plan, changed []string) []types.Link {
+	changedFiles := make(map[string]bool, len(changed))
+	for _, path := range changed {
+		changedFiles[fs.PathKey(path)] = true
+	}
+	drifted := make(map[string]bool)
+	for _, d := range check.ComparePlans(last, p) {
+		if d.Generated != nil {
+			drifted[fs.PathKey(d.Target)] = true
+		}
+	}
+
+	var links []types.Link
+	for _, link := range p.Links {
+		if drifted[fs.PathKey(link.Target)] || (link.Action != "link" && changedFiles[fs.PathKey(link.Source)]) {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// verifyDeploy checks the links the last apply attempted and rolls them
+// back if the apply failed or any of them is not OK
+func verifyDeploy(applier *apply.Applier, p *types.Plan, applyErr error, opts types.ApplyOptions) error {
+	result := applier.LastResult()
+	if result == nil {
+		// Apply stopped before touching any link (lock, confirmation, ...)
+		return nil
+	}
+
+	tried := make(map[string]bool, len(result.Links))
+	for _, lr := range result.Links {
+		if lr.Outcome != types.OutcomeSkipped {
+			tried[lr.Target] = true
+		}
+	}
+	attempted := &types.Plan{}
+	for _, link := range p.Links {
+		if tried[link.Target] {
+			attempted.Links = append(attempted.Links, link)
+		}
+	}
+
+	fmt.Printf("\n[INFO] Checking %d deployed links...\n", len(attempted.Links))
+	report := newChecker().CheckPlan(attempted)
+	if applyErr == nil && report.AllOK {
+		fmt.Println("[INFO] Post-deploy check passed")
+		return nil
+	}
+
+	check.PrintReport(report, flagVerbose, true)
+	fmt.Println("\n[INFO] Post-deploy check failed, rolling back...")
+	if err := applier.Rollback(opts); err != nil {
+		return fmt.Errorf("deploy failed and rollback was incomplete: %w", err)
+	}
+	if applyErr != nil {
+		return fmt.Errorf("deploy rolled back: %w", applyErr)
+	}
+	return fmt.Errorf("deploy rolled back: post-deploy check failed")
+}
+
+// nonInteractiveTimeout bounds hooks and privileged commands when nobody
+// is at a terminal to notice a hang or answer a prompt
+const nonInteractiveTimeout = 10 * time.Minute
+
+// applyTimeout returns --timeout if given, otherwise no limit when stdin is
+// a terminal and nonInteractiveTimeout when it is not
+func applyTimeout(cmd *cobra.Command) time.Duration {
+	if cmd.Flags().Changed("timeout") {
+		return flagTimeout
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return 0
+	}
+	return nonInteractiveTimeout
+}
+
+// requireCleanSources fails if any git-backed source directory has
+// uncommitted changes, listing the dirty files. Sources outside a git
+// working tree are not checked.
+func requireCleanSources(sources []string) error {
+	dirty := 0
+	for _, src := range sources {
+		if !repo.InWorkTree(src) {
+			if flagVerbose {
+				fmt.Printf("[INFO] Not a git working tree, skipping clean check: %s\n", src)
+			}
+			continue
+		}
+		files, err := repo.DirtyFiles(src)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		dirty++
+		fmt.Fprintf(os.Stderr, "[ERROR] Source has uncommitted changes: %s\n", src)
+		for _, f := range files {
+			fmt.Fprintf(os.Stderr, "  %s\n", f)
+		}
+	}
+	if dirty > 0 {
+		return fmt.Errorf("%d sources have uncommitted changes (--require-clean)", dirty)
+	}
+	return nil
+}
+
+func runCheck(cmd *cobra.Command, args []string) error {
+	if len(flagOverlap) > 0 {
+		return runOverlapCheck(flagOverlap)
+	}
+	if flagAuditOverwrites {
+		return runAuditOverwrites()
+	}
+	if len(flagStaleScan) > 0 && !flagStale {
+		return fmt.Errorf("--scan is only used with --stale")
+	}
+
+	p, err := loadCheckPlan(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	warnSudoLinks(p)
+
+	allOK := true
+
+	if flagCheckExport != "" || flagCompareTo != "" {
+		return runSnapshotCheck(p)
+	}
+
+	if flagStale {
+		return runStaleCheck(p)
+	}
+
+	if flagCountOnly || len(flagCountStatus) > 0 {
+		return runCountCheck(p)
+	}
+
+	if flagCheckJSON {
+		checker := newChecker()
+		report := checker.CheckPlan(p)
+		if flagTargetOwnerCheck {
+			checker.CheckOwnership(report)
+		}
+		if flagDereference {
+			checker.CheckDereference(report)
+		}
+		if flagResolve {
+			checker.ResolveTargets(report)
+		}
+		if err := check.WriteJSON(os.Stdout, report); err != nil {
+			return err
+		}
+		if !report.AllOK {
+			exit(1)
+		}
+		return nil
+	}
+
+	// Check symlinks
+	if len(p.Links) > 0 {
+		checker := newChecker()
+		report := checker.CheckPlan(p)
+		if flagTargetOwnerCheck {
+			checker.CheckOwnership(report)
+		}
+		if flagDereference {
+			checker.CheckDereference(report)
+		}
+		if flagResolve {
+			checker.ResolveTargets(report)
+		}
+		if flagGroupByBase {
+			check.PrintGroupedReport(report, flagVerbose, flagIgnoreOK)
+		} else {
+			check.PrintReport(report, flagVerbose, flagIgnoreOK)
+		}
+		if !report.AllOK {
 			allOK = false
 		}
+
+		if flagRepairMissingDirs && report.ByStatus[types.StatusParentMissing] > 0 {
+			repaired, err := checker.RepairMissingDirs(report, flagDryRun)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("[INFO] Repaired %d missing parent directories\n", len(repaired))
+		}
 	}
 
 	// Check repos
@@ -383,9 +1428,450 @@ func runCheck(cmd *cobra.Command, args []string) error {
 
 	// Return exit code based on result
 	if !allOK {
-		os.Exit(1)
+		exit(1)
+	}
+
+	return nil
+}
+
+// runCountCheck handles check --count-only: it prints a single number, the
+// non-OK links or those with a --count-status, for dashboards and status bars
+func runCountCheck(p *types.Plan) error {
+	statuses, err := check.ParseStatuses(flagCountStatus)
+	if err != nil {
+		return err
+	}
+
+	checker := newChecker()
+	report := checker.CheckPlan(p)
+	if flagTargetOwnerCheck {
+		checker.CheckOwnership(report)
+	}
+	if flagDereference {
+		checker.CheckDereference(report)
+	}
+
+	fmt.Println(check.CountStatuses(report, statuses))
+	if !report.AllOK {
+		exit(1)
+	}
+	return nil
+}
+
+// runSnapshotCheck handles check --export and --compare-to: both record the
+// current state of the plan's targets; --compare-to reports drift and exits
+// non-zero if any target changed
+func runSnapshotCheck(p *types.Plan) error {
+	// Read the old snapshot first: --export may overwrite the same file
+	var snapshot *types.LinkSnapshot
+	if flagCompareTo != "" {
+		var err error
+		if snapshot, err = check.ReadSnapshot(flagCompareTo); err != nil {
+			return err
+		}
 	}
 
+	report := newChecker().CheckPlan(p)
+	current := check.NewSnapshot(report)
+
+	if flagCheckExport != "" {
+		if err := check.WriteSnapshot(flagCheckExport, current); err != nil {
+			return err
+		}
+		fmt.Printf("[INFO] Snapshot of %d targets written: %s\n", len(current.Targets), flagCheckExport)
+	}
+
+	if snapshot == nil {
+		return nil
+	}
+	drifts := check.CompareSnapshots(snapshot, current)
+	check.PrintDrift(drifts)
+	if len(drifts) > 0 {
+		fmt.Printf("[WARN] %d targets changed since %s\n", len(drifts), snapshot.Timestamp.Format(time.RFC3339))
+		exit(1)
+	}
+	fmt.Printf("[SUCCESS] No changes since %s\n", snapshot.Timestamp.Format(time.RFC3339))
+	return nil
+}
+
+// runStaleCheck reports symlinks into the plan's sources, found under the
+// --scan directories, that are not targets of the plan
+func runStaleCheck(p *types.Plan) error {
+	roots := flagStaleScan
+	if len(roots) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to get home directory: %w", err)
+		}
+		roots = []string{home}
+	}
+
+	stale, err := check.FindStale(p, roots)
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		fmt.Printf("[SUCCESS] No stale links under %s\n", strings.Join(roots, ", "))
+		return nil
+	}
+	check.PrintStale(stale)
+	return fmt.Errorf("%d stale links point into the sources but are not in the plan", len(stale))
+}
+
+// runOverlapCheck reports targets managed by more than one plan file
+func runOverlapCheck(planFiles []string) error {
+	if len(planFiles) < 2 {
+		return fmt.Errorf("--overlap needs at least two plan files")
+	}
+
+	plans := make([]*types.Plan, len(planFiles))
+	for i, planFile := range planFiles {
+		p, err := apply.ReadPlan(planFile)
+		if err != nil {
+			return fmt.Errorf("%s: %w", planFile, err)
+		}
+		plans[i] = p
+	}
+
+	overlaps := check.FindOverlaps(planFiles, plans)
+	if len(overlaps) == 0 {
+		fmt.Printf("[SUCCESS] No target is claimed by more than one of %d plans\n", len(plans))
+		return nil
+	}
+	check.PrintOverlaps(overlaps)
+	return fmt.Errorf("%d targets are claimed by more than one plan", len(overlaps))
+}
+
+// runAuditOverwrites lists the real files past applies replaced, as JSON
+// with --json
+func runAuditOverwrites() error {
+	overwrites, err := apply.LoadOverwrites()
+	if err != nil {
+		return err
+	}
+	if flagCheckJSON {
+		if overwrites == nil {
+			overwrites = []types.Overwrite{}
+		}
+		data, err := json.MarshalIndent(overwrites, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal overwrites: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	if len(overwrites) == 0 {
+		fmt.Printf("[SUCCESS] No real file has been overwritten by cdm\n")
+		return nil
+	}
+	apply.PrintOverwrites(overwrites)
+	fmt.Printf("[INFO] %d real files were overwritten by cdm\n", len(overwrites))
+	return nil
+}
+
+// newChecker creates a checker configured from the check flags
+func newChecker() *check.Checker {
+	checker := check.NewChecker(flagVerbose)
+	if flagParallelCheck {
+		checker.SetWorkers(flagConcurrency)
+	}
+	checker.SetFollowSourceSymlinks(flagFollowSources)
+	return checker
+}
+
+// loadCheckPlan returns the plan to check: read from --plan, or
+// regenerated in memory from the sources (like deploy)
+func loadCheckPlan(cmd *cobra.Command, args []string) (*types.Plan, error) {
+	// --plan-file stands in for --plan unless sources were asked for
+	if flagCheckPlan == "" && flagPlanFile != "" && len(args) == 0 && !cmd.Flags().Changed("from-source") {
+		flagCheckPlan = flagPlanFile
+	}
+
+	if flagCheckPlan != "" {
+		if cmd.Flags().Changed("from-source") && flagFromSource {
+			return nil, fmt.Errorf("--plan and --from-source are mutually exclusive")
+		}
+		if len(args) > 0 {
+			return nil, fmt.Errorf("source paths cannot be used with --plan")
+		}
+		if flagCheckPlan != apply.StdioPlan {
+			if _, err := os.Stat(flagCheckPlan); os.IsNotExist(err) {
+				return nil, fmt.Errorf("plan file not found: %s", flagCheckPlan)
+			}
+		}
+		p, err := apply.ReadPlan(flagCheckPlan)
+		if err != nil {
+			return nil, err
+		}
+		// On stderr, so that --json and --count-only output stays parseable
+		if p.Comment != "" {
+			fmt.Fprintf(os.Stderr, "[INFO] Plan comment: %s\n", p.Comment)
+		}
+		return p, filterBase(p)
+	}
+
+	if !flagFromSource {
+		return nil, fmt.Errorf("--from-source=false requires --plan")
+	}
+
+	// Get source paths (same pattern as plan/deploy)
+	sourcePaths, err := getSourcePaths(args)
+	if err != nil {
+		return nil, err
+	}
+
+	generator, err := newGenerator()
+	if err != nil {
+		return nil, err
+	}
+	p, err := generator.Generate(sourcePaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate plan: %w", err)
+	}
+	return p, nil
+}
+
+// resolvePlanFile returns the plan file a command reads: the positional
+// argument, then --plan-file, then ./cdm-plan.json
+func resolvePlanFile(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	if flagPlanFile != "" {
+		return flagPlanFile
+	}
+	return "./cdm-plan.json"
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	p, err := loadCheckPlan(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	local := newChecker().CheckPlan(p)
+	local.Home, _ = os.UserHomeDir()
+	if local.Hostname == "" {
+		local.Hostname = "local"
+	}
+
+	remote, err := check.RemoteCheck(flagRemote, flagRemoteCmd, args)
+	if err != nil {
+		return err
+	}
+
+	diffs := check.CompareReports(local, remote)
+	check.PrintDiffs(diffs, local, remote)
+
+	if len(diffs) > 0 {
+		fmt.Printf("[WARN] %d targets differ between %s and %s\n", len(diffs), local.Hostname, remote.Hostname)
+		exit(1)
+	}
+	fmt.Printf("[SUCCESS] %s and %s are identical (%d targets)\n", local.Hostname, remote.Hostname, local.Total)
+	return nil
+}
+
+func runTree(cmd *cobra.Command, args []string) error {
+	sourcePaths, err := getSourcePaths(args)
+	if err != nil {
+		return err
+	}
+
+	generator, err := newGenerator()
+	if err != nil {
+		return err
+	}
+	p, err := generator.Generate(sourcePaths)
+	if err != nil {
+		return fmt.Errorf("failed to generate plan: %w", err)
+	}
+
+	tree.PrintTree(p)
+	return nil
+}
+
+func runUninstall(cmd *cobra.Command, args []string) error {
+	planFile := resolvePlanFile(args)
+
+	if planFile != apply.StdioPlan {
+		if _, err := os.Stat(planFile); os.IsNotExist(err) {
+			return fmt.Errorf("plan file not found: %s", planFile)
+		}
+	}
+
+	p, err := apply.ReadPlan(planFile)
+	if err != nil {
+		return err
+	}
+	if err := filterBase(p); err != nil {
+		return err
+	}
+
+	applier := apply.NewApplier(flagVerbose)
+	return applier.Uninstall(p, getApplyOptions(), flagOrphansOnly)
+}
+
+func runAdopt(cmd *cobra.Command, args []string) error {
+	srcDir := flagAdoptInto
+	if srcDir == "" {
+		cdmBase := getCdmBase()
+		if cdmBase == "" {
+			return fmt.Errorf("no --into directory specified and CDM_BASE not set")
+		}
+		srcDir = filepath.Join(cdmBase, "share")
+	}
+	srcDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	applier := apply.NewApplier(flagVerbose)
+	adopted, adoptErr := applier.Adopt(args, srcDir, getApplyOptions())
+
+	if flagAdoptCommit && len(adopted) > 0 {
+		if flagDryRun {
+			fmt.Printf("[DRY-RUN] Would commit %d files in %s\n", len(adopted), srcDir)
+		} else {
+			message := fmt.Sprintf("cdm adopt: %d files", len(adopted))
+			if len(adopted) == 1 {
+				if rel, err := filepath.Rel(srcDir, adopted[0]); err == nil {
+					message = "cdm adopt: " + rel
+				}
+			}
+			if err := repo.Commit(srcDir, message, adopted); err != nil {
+				return err
+			}
+		}
+	}
+
+	return adoptErr
+}
+
+func runExplain(cmd *cobra.Command, args []string) error {
+	target, err := fs.ExpandPath(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to expand path: %w", err)
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	sourcePaths, err := getSourcePaths(args[1:])
+	if err != nil {
+		return err
+	}
+
+	generator, err := newGenerator()
+	if err != nil {
+		return err
+	}
+	generator.SetExplain(target)
+	p, err := generator.Generate(sourcePaths)
+	if err != nil {
+		return fmt.Errorf("failed to generate plan: %w", err)
+	}
+
+	fmt.Printf("Target: %s\n", target)
+	for _, step := range generator.Explanation().Steps {
+		fmt.Printf("  %s\n", step)
+	}
+
+	for _, link := range p.Links {
+		if fs.SamePath(link.Target, target) || (p.Root != "" && fs.SamePath(link.Target, filepath.Join(p.Root, target))) {
+			fmt.Printf("[RESULT] %s %s -> %s (%s)\n", link.Action, link.Target, link.Source, link.Reason)
+			return nil
+		}
+	}
+	fmt.Printf("[RESULT] Not in plan\n")
+	return nil
+}
+
+func runBench(cmd *cobra.Command, args []string) error {
+	result, err := bench.Run(flagBenchFiles, flagVerbose)
+	if err != nil {
+		return err
+	}
+
+	bench.PrintResult(result)
+	return nil
+}
+
+func runGenerateConfig(cmd *cobra.Command, args []string) error {
+	srcPath := "."
+	if len(args) > 0 {
+		srcPath = args[0]
+	}
+
+	absPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	gen, err := config.Suggest(absPath)
+	if err != nil {
+		return err
+	}
+
+	if flagDryRun {
+		data, err := json.MarshalIndent(gen, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	configPath, err := config.WriteGenerated(absPath, gen, flagForce)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[SUCCESS] Config written: %s\n", configPath)
+	fmt.Printf("  Excludes: %d\n", len(gen.Exclude))
+	fmt.Printf("  Link folders: %d\n", len(gen.LinkFolders))
+	return nil
+}
+
+func runValidatePlan(cmd *cobra.Command, args []string) error {
+	planFile := resolvePlanFile(args)
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	if planFile != apply.StdioPlan {
+		if _, err := os.Stat(planFile); os.IsNotExist(err) {
+			return fmt.Errorf("plan file not found: %s", planFile)
+		}
+	}
+	planned, err := apply.ReadPlan(planFile)
+	if err != nil {
+		return err
+	}
+	if err := filterBase(planned); err != nil {
+		return err
+	}
+
+	sourcePaths, err := getSourcePaths(args)
+	if err != nil {
+		return err
+	}
+	generator, err := newGenerator()
+	if err != nil {
+		return err
+	}
+	generated, err := generator.Generate(sourcePaths)
+	if err != nil {
+		return fmt.Errorf("failed to generate plan: %w", err)
+	}
+
+	drifts := check.ComparePlans(planned, generated)
+	if len(drifts) == 0 {
+		fmt.Printf("[SUCCESS] %s matches the sources (%d links)\n", planFile, len(planned.Links))
+		return nil
+	}
+	check.PrintPlanDrift(drifts)
+	fmt.Printf("[WARN] %s is out of date: %d targets differ from the sources\n", planFile, len(drifts))
+	exit(1)
 	return nil
 }
 
@@ -12,6 +12,9 @@ import (
 
 const ConfigFileName = ".cdm.conf.json"
 
+// DefaultNoRecurse lists directory names never searched for nested configs
+var DefaultNoRecurse = []string{".git", "node_modules"}
+
 // Loader handles configuration file loading
 type Loader struct{}
 
@@ -23,13 +26,19 @@ func NewLoader() *Loader {
 // Load loads configuration from a source directory
 func (l *Loader) Load(sourcePath string) (*types.Config, error) {
 	configPath := filepath.Join(sourcePath, ConfigFileName)
+	if _, err := os.Stat(configPath); os.IsNotExist(err) || os.IsPermission(err) {
+		// No config file, return empty config; directories that cannot be
+		// searched are reported by the scan
+		return &types.Config{}, nil
+	}
+	return l.LoadFile(configPath)
+}
 
+// LoadFile loads a configuration file; unlike Load, a missing file is an
+// error
+func (l *Loader) LoadFile(configPath string) (*types.Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// No config file, return empty config
-			return &types.Config{}, nil
-		}
 		return nil, fmt.Errorf("failed to read config file %s: %w", configPath, err)
 	}
 
@@ -42,10 +51,20 @@ func (l *Loader) Load(sourcePath string) (*types.Config, error) {
 }
 
 // LoadAll loads configurations from multiple source directories
-// Includes recursive loading of subdirectory configs
-func (l *Loader) LoadAll(sourcePaths []string) (map[string]*types.Config, error) {
+// Includes recursive loading of subdirectory configs. A non-empty
+// sourceConfig file is merged into the root config of every source as if
+// it lived there (see MergeConfig).
+func (l *Loader) LoadAll(sourcePaths []string, sourceConfig string) (map[string]*types.Config, error) {
 	configs := make(map[string]*types.Config)
 
+	var external *types.Config
+	if sourceConfig != "" {
+		var err error
+		if external, err = l.LoadFile(sourceConfig); err != nil {
+			return nil, err
+		}
+	}
+
 	for _, path := range sourcePaths {
 		absPath, err := filepath.Abs(path)
 		if err != nil {
@@ -57,10 +76,14 @@ func (l *Loader) LoadAll(sourcePaths []string) (map[string]*types.Config, error)
 		if err != nil {
 			return nil, err
 		}
+		if external != nil {
+			config = MergeConfig(external, config)
+		}
 		configs[absPath] = config
 
 		// Recursively load subdirectory configs
-		subConfigs, err := l.loadRecursive(absPath, absPath)
+		noRecurse := append(append([]string(nil), DefaultNoRecurse...), config.NoRecurse...)
+		subConfigs, err := l.loadRecursive(absPath, absPath, noRecurse)
 		if err != nil {
 			return nil, err
 		}
@@ -72,12 +95,18 @@ func (l *Loader) LoadAll(sourcePaths []string) (map[string]*types.Config, error)
 	return configs, nil
 }
 
-// loadRecursive recursively finds and loads all .cdm.conf.json files
-func (l *Loader) loadRecursive(basePath, currentPath string) (map[string]*types.Config, error) {
+// loadRecursive recursively finds and loads all .cdm.conf.json files,
+// skipping directories whose name matches a noRecurse glob. The globs of
+// a config also apply to the directories below it.
+func (l *Loader) loadRecursive(basePath, currentPath string, noRecurse []string) (map[string]*types.Config, error) {
 	configs := make(map[string]*types.Config)
 
 	entries, err := os.ReadDir(currentPath)
 	if err != nil {
+		// Unreadable subdirectories are reported by the scan
+		if os.IsPermission(err) && currentPath != basePath {
+			return configs, nil
+		}
 		return nil, err
 	}
 
@@ -87,6 +116,9 @@ func (l *Loader) loadRecursive(basePath, currentPath string) (map[string]*types.
 		}
 
 		subDirPath := filepath.Join(currentPath, entry.Name())
+		if matchesAny(noRecurse, entry.Name()) {
+			continue
+		}
 
 		// Try to load config from this subdirectory
 		config, err := l.Load(subDirPath)
@@ -96,14 +128,22 @@ func (l *Loader) loadRecursive(basePath, currentPath string) (map[string]*types.
 
 		// Only add if config has content (not empty)
 		if config.Version != "" || len(config.PathMappings) > 0 ||
-			len(config.Exclude) > 0 || len(config.LinkFolders) > 0 ||
+			len(config.Exclude) > 0 || len(config.LinkFolders) > 0 || len(config.MergeFolders) > 0 ||
 			len(config.Repos) > 0 || len(config.FileMappings) > 0 ||
-			config.Hooks != nil {
+			config.Hooks != nil || config.RequireConfirm ||
+			len(config.Ownership) > 0 || len(config.Permissions) > 0 || len(config.DirPermissions) > 0 || config.Layout != "" ||
+			config.IncludeHidden != nil || config.ExcludeNestedHidden || len(config.TargetExclude) > 0 || config.ShellSpecific ||
+			len(config.NoBackup) > 0 || len(config.AlwaysBackup) > 0 || len(config.ExcludeExtensions) > 0 || config.ExcludeCmd != "" ||
+			len(config.NoRecurse) > 0 || len(config.Xattrs) > 0 {
 			configs[subDirPath] = config
 		}
 
 		// Recurse into subdirectories
-		subConfigs, err := l.loadRecursive(basePath, subDirPath)
+		subNoRecurse := noRecurse
+		if len(config.NoRecurse) > 0 {
+			subNoRecurse = append(append([]string(nil), noRecurse...), config.NoRecurse...)
+		}
+		subConfigs, err := l.loadRecursive(basePath, subDirPath, subNoRecurse)
 		if err != nil {
 			return nil, err
 		}
@@ -114,3 +154,13 @@ func (l *Loader) loadRecursive(basePath, currentPath string) (map[string]*types.
 
 	return configs, nil
 }
+
+// matchesAny reports whether name matches any of the globs
+func matchesAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
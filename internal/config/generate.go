@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// LargeFileSize is the size above which binary files are suggested for exclusion
+const LargeFileSize = 1 << 20
+
+// vcsDirs are version control metadata directories that are never dotfiles
+var vcsDirs = []string{".git", ".hg", ".svn", ".bzr"}
+
+// backupPatterns are editor and tool leftovers that are never dotfiles
+var backupPatterns = []string{"*.bak", "*.orig", "*.swp", "*.swo", "*~", "*.backup.*", ".DS_Store"}
+
+// pluginDirs are directory names used by common plugin managers; their
+// contents are managed by the plugin manager and should be linked as a whole
+var pluginDirs = map[string]bool{
+	"plugged":    true, // vim-plug
+	"bundle":     true, // Vundle, pathogen
+	"pack":       true, // vim/neovim native packages
+	"lazy":       true, // lazy.nvim
+	"plugins":    true, // tpm (~/.tmux/plugins), zsh plugin dirs
+	".oh-my-zsh": true,
+	"oh-my-zsh":  true,
+	".zinit":     true,
+	".antigen":   true,
+}
+
+// GeneratedConfig is a suggested config with the reasoning behind each entry.
+// Notes are written under the "//" key, which the loader ignores.
+type GeneratedConfig struct {
+	Notes []string `json:"//,omitempty"`
+	*types.Config
+}
+
+// Suggest scans a source tree and proposes excludes and linkFolders for it
+func Suggest(root string) (*GeneratedConfig, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	gen := &GeneratedConfig{Config: &types.Config{}}
+	seenPatterns := make(map[string]bool)
+
+	addExclude := func(pattern, note string) {
+		if seenPatterns[pattern] {
+			return
+		}
+		seenPatterns[pattern] = true
+		gen.Exclude = append(gen.Exclude, types.Conditional{Value: pattern})
+		gen.Notes = append(gen.Notes, fmt.Sprintf("exclude %q: %s", pattern, note))
+	}
+
+	err = filepath.Walk(absRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == absRoot {
+			return nil
+		}
+
+		rel, err := filepath.Rel(absRoot, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+
+		if info.IsDir() {
+			for _, vcs := range vcsDirs {
+				if info.Name() == vcs {
+					addExclude(vcs, "version control metadata")
+					return filepath.SkipDir
+				}
+			}
+
+			// A nested repository is usually a cloned plugin or theme
+			if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+				gen.LinkFolders = append(gen.LinkFolders, types.Conditional{Value: rel})
+				gen.Notes = append(gen.Notes, fmt.Sprintf("linkFolders %q: contains its own git repository", rel))
+				return filepath.SkipDir
+			}
+
+			if pluginDirs[info.Name()] {
+				gen.LinkFolders = append(gen.LinkFolders, types.Conditional{Value: rel})
+				gen.Notes = append(gen.Notes, fmt.Sprintf("linkFolders %q: looks like a plugin manager directory", rel))
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		for _, pattern := range backupPatterns {
+			if ok, _ := filepath.Match(pattern, info.Name()); ok {
+				addExclude(pattern, "backup or editor temporary file (e.g. "+rel+")")
+				return nil
+			}
+		}
+
+		if info.Mode().IsRegular() && info.Size() > LargeFileSize && isBinary(path) {
+			addExclude(rel, fmt.Sprintf("large binary file (%d bytes)", info.Size()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", absRoot, err)
+	}
+
+	sort.Slice(gen.LinkFolders, func(i, j int) bool {
+		return gen.LinkFolders[i].Value < gen.LinkFolders[j].Value
+	})
+	return gen, nil
+}
+
+// isBinary reports whether a file's leading bytes contain a NUL byte
+func isBinary(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, 8000)
+	n, err := f.Read(buf)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
+
+// WriteGenerated writes a suggested config to dir/.cdm.conf.json.
+// An existing config is only replaced when force is set.
+func WriteGenerated(dir string, gen *GeneratedConfig, force bool) (string, error) {
+	configPath := filepath.Join(dir, ConfigFileName)
+	if _, err := os.Stat(configPath); err == nil && !force {
+		return "", fmt.Errorf("config file already exists: %s (use --force to overwrite)", configPath)
+	}
+
+	data, err := json.MarshalIndent(gen, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if err := os.WriteFile(configPath, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write config file %s: %w", configPath, err)
+	}
+	return configPath, nil
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// HostGroupsFileName is the file in CDM_BASE that maps hosts to layers
+const HostGroupsFileName = "hostgroups.json"
+
+// HostLayer returns the name of the host-specific layer directory in
+// cdmBase for hostname: the layer of the first host group with a matching
+// hostname pattern, or the hostname itself if no group matches or there
+// is no hostgroups.json
+func HostLayer(cdmBase, hostname string) (string, error) {
+	file := filepath.Join(cdmBase, HostGroupsFileName)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return hostname, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	var groups types.HostGroups
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	for _, group := range groups.Groups {
+		if group.Layer == "" || filepath.Base(group.Layer) != group.Layer {
+			return "", fmt.Errorf("invalid layer %q in %s: must be a directory name", group.Layer, file)
+		}
+		for _, pattern := range group.Hosts {
+			ok, err := path.Match(pattern, hostname)
+			if err != nil {
+				return "", fmt.Errorf("invalid host pattern %q in %s: %w", pattern, file, err)
+			}
+			if ok {
+				return group.Layer, nil
+			}
+		}
+	}
+	return hostname, nil
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LayersEnv names the environment variable holding the layer template
+const LayersEnv = "CDM_LAYERS"
+
+// DefaultLayers is the layer template used when CDM_LAYERS is unset
+const DefaultLayers = "share,<hostname>"
+
+// ExpandLayers turns a comma-separated layer template, lowest precedence
+// first, into CDM_BASE directory names. "<hostname>" is replaced by the
+// host layer (see HostLayer), "<os>" by the operating system (linux,
+// darwin, ...) and "<arch>" by the CPU architecture.
+func ExpandLayers(template, hostLayer string) ([]string, error) {
+	replacer := strings.NewReplacer(
+		"<hostname>", hostLayer,
+		"<os>", runtime.GOOS,
+		"<arch>", runtime.GOARCH,
+	)
+
+	var layers []string
+	for _, item := range strings.Split(template, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		layer := replacer.Replace(item)
+		if strings.ContainsAny(layer, "<>") || filepath.Base(layer) != layer || layer == "." || layer == ".." {
+			return nil, fmt.Errorf("invalid layer %q in %s: must be a directory name or one of <hostname>, <os>, <arch>", item, LayersEnv)
+		}
+		layers = append(layers, layer)
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("%s lists no layers", LayersEnv)
+	}
+	return layers, nil
+}
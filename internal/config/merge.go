@@ -0,0 +1,81 @@
+package config
+
+import "github.com/woodgear/cdm/pkg/types"
+
+// MergeConfig merges an external config with the in-tree config of the
+// same directory. Lists are concatenated (external rules first), map
+// entries and set scalars of the in-tree config win, and flags are set if
+// either config sets them.
+func MergeConfig(external, inTree *types.Config) *types.Config {
+	merged := *inTree
+
+	if merged.Version == "" {
+		merged.Version = external.Version
+	}
+	if merged.Layout == "" {
+		merged.Layout = external.Layout
+	}
+	if merged.ExcludeCmd == "" {
+		merged.ExcludeCmd = external.ExcludeCmd
+	}
+	if merged.Hooks == nil {
+		merged.Hooks = external.Hooks
+	}
+	if merged.IncludeHidden == nil {
+		merged.IncludeHidden = external.IncludeHidden
+	}
+
+	merged.RequireConfirm = external.RequireConfirm || inTree.RequireConfirm
+	merged.ExcludeNestedHidden = external.ExcludeNestedHidden || inTree.ExcludeNestedHidden
+	merged.ShellSpecific = external.ShellSpecific || inTree.ShellSpecific
+
+	merged.PathMappings = concat(external.PathMappings, inTree.PathMappings)
+	merged.FileMappings = concat(external.FileMappings, inTree.FileMappings)
+	merged.Exclude = concat(external.Exclude, inTree.Exclude)
+	merged.LinkFolders = concat(external.LinkFolders, inTree.LinkFolders)
+	merged.MergeFolders = concat(external.MergeFolders, inTree.MergeFolders)
+	merged.Repos = concat(external.Repos, inTree.Repos)
+	merged.TargetExclude = concat(external.TargetExclude, inTree.TargetExclude)
+	merged.NoBackup = concat(external.NoBackup, inTree.NoBackup)
+	merged.AlwaysBackup = concat(external.AlwaysBackup, inTree.AlwaysBackup)
+	merged.ExcludeExtensions = concat(external.ExcludeExtensions, inTree.ExcludeExtensions)
+	merged.NoRecurse = concat(external.NoRecurse, inTree.NoRecurse)
+
+	merged.Ownership = mergeMap(external.Ownership, inTree.Ownership)
+	merged.Permissions = mergeMap(external.Permissions, inTree.Permissions)
+	merged.DirPermissions = mergeMap(external.DirPermissions, inTree.DirPermissions)
+	if len(external.Xattrs) > 0 {
+		merged.Xattrs = make(map[string]map[string]string, len(external.Xattrs)+len(inTree.Xattrs))
+		for glob, attrs := range external.Xattrs {
+			merged.Xattrs[glob] = attrs
+		}
+		for glob, attrs := range inTree.Xattrs {
+			merged.Xattrs[glob] = mergeMap(external.Xattrs[glob], attrs)
+		}
+	}
+
+	return &merged
+}
+
+// concat returns a new slice holding a followed by b
+func concat[T any](a, b []T) []T {
+	if len(a) == 0 {
+		return b
+	}
+	return append(append([]T(nil), a...), b...)
+}
+
+// mergeMap returns the entries of both maps, b winning on conflicts
+func mergeMap(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	merged := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
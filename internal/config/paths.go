@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StateDir returns the directory where CDM keeps its own runtime state
+// (last applied plan, lock file, temporary deploy plans).
+// Uses $XDG_STATE_HOME/cdm, falling back to ~/.local/state/cdm.
+func StateDir() (string, error) {
+	return xdgDir("XDG_STATE_HOME", ".local", "state")
+}
+
+// CacheDir returns the directory where CDM caches downloaded data
+// (remote git sources, fetched plans).
+// Uses $XDG_CACHE_HOME/cdm, falling back to ~/.cache/cdm.
+func CacheDir() (string, error) {
+	return xdgDir("XDG_CACHE_HOME", ".cache")
+}
+
+// EnsureStateDir returns the state directory, creating it if needed
+func EnsureStateDir() (string, error) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create state directory %s: %w", stateDir, err)
+	}
+	return stateDir, nil
+}
+
+// xdgDir returns the cdm directory under an XDG base directory, or under
+// the given fallback path relative to the home directory when the
+// variable is unset. Relative values are ignored as the spec requires.
+func xdgDir(env string, fallback ...string) (string, error) {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "cdm"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(append(append([]string{home}, fallback...), "cdm")...), nil
+}
@@ -0,0 +1,38 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Backup styles accepted by --backup-style
+const (
+	BackupStyleSuffix = "suffix" // <target>.backup.<timestamp> (default)
+	BackupStyleTilde  = "tilde"  // <target>~, replacing an older backup
+	BackupStyleDir    = "dir"    // .bak/<name>.<timestamp> next to the target
+)
+
+// BackupDirName is the directory holding backups of the "dir" style
+const BackupDirName = ".bak"
+
+// ValidateBackupStyle checks a --backup-style value ("" selects the default)
+func ValidateBackupStyle(style string) error {
+	switch style {
+	case "", BackupStyleSuffix, BackupStyleTilde, BackupStyleDir:
+		return nil
+	}
+	return fmt.Errorf("invalid backup style %q: expected %s, %s or %s", style, BackupStyleSuffix, BackupStyleTilde, BackupStyleDir)
+}
+
+// BackupPath returns where target is backed up under a backup style
+func BackupPath(target, style string, now time.Time) string {
+	stamp := now.Format("20060102_150405")
+	switch style {
+	case BackupStyleTilde:
+		return target + "~"
+	case BackupStyleDir:
+		return filepath.Join(filepath.Dir(target), BackupDirName, filepath.Base(target)+"."+stamp)
+	}
+	return target + ".backup." + stamp
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	caseInsensitiveOnce sync.Once
+	caseInsensitive     bool
+)
+
+// IsCaseInsensitive reports whether target paths should be compared
+// case-insensitively. True on darwin, or when a probe in the home
+// directory shows the filesystem folds case.
+func IsCaseInsensitive() bool {
+	caseInsensitiveOnce.Do(func() {
+		if runtime.GOOS == "darwin" {
+			caseInsensitive = true
+			return
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			caseInsensitive = probeCaseInsensitive(home)
+		}
+	})
+	return caseInsensitive
+}
+
+// probeCaseInsensitive creates a lowercase temp file in dir and checks
+// whether its uppercase name resolves to the same file
+func probeCaseInsensitive(dir string) bool {
+	f, err := os.CreateTemp(dir, ".cdm-case-probe-")
+	if err != nil {
+		return false
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	upper := filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name)))
+	lowerInfo, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	upperInfo, err := os.Stat(upper)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(lowerInfo, upperInfo)
+}
+
+// PathKey normalizes a path for use as a map key, folding case on
+// case-insensitive filesystems
+func PathKey(path string) string {
+	if IsCaseInsensitive() {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// SamePath compares two paths, ignoring case on case-insensitive filesystems
+func SamePath(a, b string) bool {
+	if IsCaseInsensitive() {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
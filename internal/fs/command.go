@@ -0,0 +1,41 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrTimeout is returned when a command is killed for exceeding its timeout
+var ErrTimeout = errors.New("command timed out")
+
+// RunCommand runs a command attached to the terminal, killing it if it runs
+// longer than timeout. A zero timeout means no limit.
+func RunCommand(dir string, timeout time.Duration, name string, args ...string) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w after %s", name, ErrTimeout, timeout)
+	}
+	return err
+}
+
+// ShellQuote quotes an argument for sh
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fs
+
+import "os"
+
+// deviceID returns the id of the device holding a file. Device ids are
+// not available on this platform.
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,53 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// CreateDir ensures target is a directory, creating it and its parents
+// with the opts.DirMode mode. An existing directory is left as is; any
+// other existing target is an error, as nothing is replaced.
+func (sm *SymlinkManager) CreateDir(target string, opts types.ApplyOptions) error {
+	info, err := os.Stat(target)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("refusing to replace %s: target exists and is not a directory", target)
+		}
+		if sm.verbose {
+			logf(opts, "[SKIP] Directory exists: %s\n", target)
+		}
+		return nil
+	}
+
+	dirMode, err := DirModeFor(opts)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would create directory: %s\n", target)
+		return nil
+	}
+
+	if isDirWritable(target) {
+		err = os.MkdirAll(target, dirMode)
+	} else {
+		priv, perr := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+		if perr != nil {
+			return perr
+		}
+		if sm.verbose {
+			logf(opts, "[SUDO] Directory not writable, will use %s for: %s\n", priv.Name(), target)
+		}
+		err = priv.Mkdir(target, dirMode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", target, err)
+	}
+	if sm.verbose {
+		logf(opts, "[MKDIR] %s\n", target)
+	}
+	return nil
+}
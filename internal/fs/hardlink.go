@@ -0,0 +1,93 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// IsSameFile checks if target and source are the same file (same inode)
+func IsSameFile(target, source string) bool {
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return false
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(targetInfo, sourceInfo)
+}
+
+// SameDevice reports whether source and the directory that will hold target
+// are on the same filesystem. Missing target directories are checked at
+// their nearest existing ancestor.
+func SameDevice(target, source string) (bool, error) {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", source, err)
+	}
+
+	dir := filepath.Dir(target)
+	dirInfo, err := os.Stat(dir)
+	for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		dirInfo, err = os.Stat(dir)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", dir, err)
+	}
+
+	sourceDev, ok1 := deviceID(sourceInfo)
+	dirDev, ok2 := deviceID(dirInfo)
+	if !ok1 || !ok2 {
+		return true, nil
+	}
+	return sourceDev == dirDev, nil
+}
+
+// CreateHardlink creates a hard link with backup and sudo support.
+// Hard links cannot point at directories or span filesystems.
+func (sm *SymlinkManager) CreateHardlink(target, source string, opts types.ApplyOptions) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", source, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot hardlink directory %s: directories can only be symlinked", source)
+	}
+
+	same, err := SameDevice(target, source)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("cannot hardlink %s -> %s: source and target are on different filesystems", target, source)
+	}
+
+	return sm.createLink(target, source, true, opts)
+}
+
+// hardlink creates the hard link once the target path has been cleared
+func (sm *SymlinkManager) hardlink(target, source string, needsSudo bool, priv Privileged, opts types.ApplyOptions) error {
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would hardlink: %s -> %s\n", target, source)
+		return nil
+	}
+
+	var err error
+	if needsSudo {
+		err = priv.Hardlink(target, source)
+	} else {
+		err = os.Link(source, target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create hard link %s: %w", target, err)
+	}
+	if sm.verbose {
+		logf(opts, "[HARDLINK] %s -> %s\n", target, source)
+	}
+	return nil
+}
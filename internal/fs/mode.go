@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// ParseMode parses an octal permission string such as "600" or "0755"
+func ParseMode(mode string) (os.FileMode, error) {
+	v, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || v > 0o7777 {
+		return 0, fmt.Errorf("invalid mode %q: expected octal permissions such as 600", mode)
+	}
+	return os.FileMode(v), nil
+}
+
+// CheckMode compares a path's permission bits with an expected octal mode.
+// Returns a description of the drift and false on mismatch.
+func CheckMode(path, mode string) (string, bool) {
+	want, err := ParseMode(mode)
+	if err != nil {
+		return err.Error(), false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Sprintf("failed to stat %s: %v", path, err), false
+	}
+	if got := info.Mode().Perm(); got != want.Perm() {
+		return fmt.Sprintf("mode is %04o, expected %04o", got, want.Perm()), false
+	}
+	return "", true
+}
+
+// EnsureMode sets a path's permissions to the expected octal mode.
+// Returns true if the mode was (or would be, in dry-run) changed.
+func (sm *SymlinkManager) EnsureMode(path, mode string, opts types.ApplyOptions) (bool, error) {
+	want, err := ParseMode(mode)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && opts.DryRun {
+		// A copy target that dry-run did not create
+		logf(opts, "[DRY-RUN] Would chmod %s: %04o\n", path, want.Perm())
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	got := info.Mode().Perm()
+	if got == want.Perm() {
+		return false, nil
+	}
+
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would chmod %s: %04o -> %04o\n", path, got, want.Perm())
+		return true, nil
+	}
+
+	err = os.Chmod(path, want)
+	if errors.Is(err, os.ErrPermission) {
+		priv, perr := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+		if perr != nil {
+			return false, perr
+		}
+		if sm.verbose {
+			logf(opts, "[SUDO] Permission denied, will use %s to chmod: %s\n", priv.Name(), path)
+		}
+		err = priv.Chmod(path, mode)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to chmod %s: %w", path, err)
+	}
+
+	logf(opts, "[CHMOD] %s: %04o -> %04o\n", path, got, want.Perm())
+	return true, nil
+}
@@ -0,0 +1,155 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Privilege tool names accepted by NewPrivileged
+const (
+	PrivilegeSudo = "sudo"
+	PrivilegeDoas = "doas"
+	PrivilegeNone = "none"
+)
+
+// Privileged performs filesystem operations that need elevated privileges
+type Privileged interface {
+	Name() string
+	Remove(path string) error
+	Mkdir(path string, mode os.FileMode) error
+	Symlink(target, source string) error
+	Hardlink(target, source string) error
+	Copy(target, source string) error
+	Move(src, dst string) error
+	Chmod(path, mode string) error
+	SetXattr(path, name, value string) error
+}
+
+// ValidatePrivilegeTool checks a --privilege-tool value ("" selects sudo)
+func ValidatePrivilegeTool(tool string) error {
+	switch tool {
+	case "", PrivilegeSudo, PrivilegeDoas, PrivilegeNone:
+		return nil
+	}
+	return fmt.Errorf("unsupported privilege tool: %s (expected %s, %s or %s)", tool, PrivilegeSudo, PrivilegeDoas, PrivilegeNone)
+}
+
+// NewPrivileged returns the privileged backend for the given tool name.
+// An empty name selects sudo, the default. Each privileged command is
+// killed after timeout (0: no limit), e.g. a password prompt nobody answers.
+func NewPrivileged(tool string, timeout time.Duration) (Privileged, error) {
+	switch tool {
+	case "", PrivilegeSudo:
+		return &commandPrivileged{tool: PrivilegeSudo, timeout: timeout}, nil
+	case PrivilegeDoas:
+		return &commandPrivileged{tool: PrivilegeDoas, timeout: timeout}, nil
+	case PrivilegeNone:
+		return nonePrivileged{}, nil
+	default:
+		return nil, ValidatePrivilegeTool(tool)
+	}
+}
+
+// commandPrivileged runs coreutils through a privilege escalation command
+// such as sudo or doas (with terminal access for password prompts)
+type commandPrivileged struct {
+	tool    string
+	timeout time.Duration
+}
+
+func (p *commandPrivileged) Name() string {
+	return p.tool
+}
+
+func (p *commandPrivileged) run(args ...string) error {
+	return RunCommand("", p.timeout, p.tool, args...)
+}
+
+// Remove removes a file
+func (p *commandPrivileged) Remove(path string) error {
+	return p.run("rm", "-f", path)
+}
+
+// Mkdir creates a directory and its parents; mode applies to the final directory
+func (p *commandPrivileged) Mkdir(path string, mode os.FileMode) error {
+	return p.run("mkdir", "-p", "-m", fmt.Sprintf("%o", mode.Perm()), path)
+}
+
+// Symlink creates a symlink at target pointing to source
+func (p *commandPrivileged) Symlink(target, source string) error {
+	return p.run("ln", "-sf", source, target)
+}
+
+// Hardlink creates a hard link at target to source
+func (p *commandPrivileged) Hardlink(target, source string) error {
+	return p.run("ln", "-f", source, target)
+}
+
+// Copy copies source to target
+func (p *commandPrivileged) Copy(target, source string) error {
+	return p.run("cp", source, target)
+}
+
+// Move renames src to dst
+func (p *commandPrivileged) Move(src, dst string) error {
+	return p.run("mv", src, dst)
+}
+
+// Chmod sets the octal mode of path
+func (p *commandPrivileged) Chmod(path, mode string) error {
+	return p.run("chmod", mode, path)
+}
+
+// SetXattr sets an extended attribute of path itself (not following a
+// symlink) with setfattr, or xattr on macOS
+func (p *commandPrivileged) SetXattr(path, name, value string) error {
+	if runtime.GOOS == "darwin" {
+		return p.run("xattr", "-s", "-w", name, value, path)
+	}
+	return p.run("setfattr", "-h", "-n", name, "-v", value, path)
+}
+
+// nonePrivileged refuses all privileged operations
+type nonePrivileged struct{}
+
+func (nonePrivileged) Name() string {
+	return PrivilegeNone
+}
+
+func (nonePrivileged) Remove(path string) error {
+	return errPrivilegeDisabled("remove", path)
+}
+
+func (nonePrivileged) Mkdir(path string, mode os.FileMode) error {
+	return errPrivilegeDisabled("create directory", path)
+}
+
+func (nonePrivileged) Symlink(target, source string) error {
+	return errPrivilegeDisabled("create symlink", target)
+}
+
+func (nonePrivileged) Hardlink(target, source string) error {
+	return errPrivilegeDisabled("create hard link", target)
+}
+
+func (nonePrivileged) Copy(target, source string) error {
+	return errPrivilegeDisabled("copy to", target)
+}
+
+func (nonePrivileged) Move(src, dst string) error {
+	return errPrivilegeDisabled("move", src)
+}
+
+func (nonePrivileged) Chmod(path, mode string) error {
+	return errPrivilegeDisabled("chmod", path)
+}
+
+func (nonePrivileged) SetXattr(path, name, value string) error {
+	return errPrivilegeDisabled("set xattr on", path)
+}
+
+func errPrivilegeDisabled(op, path string) error {
+	return fmt.Errorf("cannot %s %s: elevated privileges required but privilege escalation is disabled: %w", op, path, os.ErrPermission)
+}
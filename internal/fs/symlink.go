@@ -2,9 +2,9 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -12,14 +12,130 @@ import (
 	"github.com/woodgear/cdm/pkg/types"
 )
 
+// ErrFrozen is returned when frozen mode forbids modifying an existing target
+var ErrFrozen = errors.New("frozen")
+
+// ErrTargetIsDir is returned when a file target is blocked by an existing directory
+var ErrTargetIsDir = errors.New("target is a directory")
+
 // SymlinkManager handles symlink operations
 type SymlinkManager struct {
 	verbose bool
+	backups map[string]string // target -> backup path created during this run
 }
 
 // NewSymlinkManager creates a new symlink manager
 func NewSymlinkManager(verbose bool) *SymlinkManager {
-	return &SymlinkManager{verbose: verbose}
+	return &SymlinkManager{
+		verbose: verbose,
+		backups: make(map[string]string),
+	}
+}
+
+// logf prints an output line of a link operation behind opts.LogPrefix, so
+// dry-run and real applies number their lines alike
+func logf(opts types.ApplyOptions, format string, args ...interface{}) {
+	fmt.Print(opts.LogPrefix + fmt.Sprintf(format, args...))
+}
+
+// BackupFor returns the backup path created for target, if any
+func (sm *SymlinkManager) BackupFor(target string) string {
+	return sm.backups[target]
+}
+
+// backupFile copies an existing target aside before it is replaced
+func (sm *SymlinkManager) backupFile(target string, opts types.ApplyOptions) error {
+	backupPath := BackupPath(target, opts.BackupStyle, time.Now())
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would backup: %s -> %s\n", target, backupPath)
+		return nil
+	}
+
+	if opts.BackupStyle == BackupStyleDir {
+		dirMode, err := DirModeFor(opts)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(backupPath), dirMode); err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+	}
+	if err := copyFile(target, backupPath); err != nil {
+		return fmt.Errorf("failed to backup %s: %w", target, err)
+	}
+	sm.backups[target] = backupPath
+	if sm.verbose {
+		logf(opts, "[BACKUP] %s -> %s\n", target, backupPath)
+	}
+	return nil
+}
+
+// DefaultDirMode is the mode of parent directories created for targets
+const DefaultDirMode os.FileMode = 0755
+
+// DirModeFor returns the mode for created parent directories: opts.DirMode
+// when set, DefaultDirMode otherwise
+func DirModeFor(opts types.ApplyOptions) (os.FileMode, error) {
+	if opts.DirMode == "" {
+		return DefaultDirMode, nil
+	}
+	return ParseMode(opts.DirMode)
+}
+
+// IsDirConflict checks if target is a real directory (not a symlink to one)
+// while source is a file, so the target cannot simply be replaced
+func IsDirConflict(target, source string) bool {
+	info, err := os.Lstat(target)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	srcInfo, err := os.Stat(source)
+	return err == nil && !srcInfo.IsDir()
+}
+
+// moveDirAside replaces a directory blocking a file target by moving it to
+// a timestamped backup path. Requires --force.
+func (sm *SymlinkManager) moveDirAside(target string, needsSudo bool, priv Privileged, opts types.ApplyOptions) error {
+	if !opts.Force {
+		return fmt.Errorf("%w: %s (use --force to replace it)", ErrTargetIsDir, target)
+	}
+
+	backupPath := BackupPath(target, opts.BackupStyle, time.Now())
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would move directory aside: %s -> %s\n", target, backupPath)
+		return nil
+	}
+
+	if opts.BackupStyle == BackupStyleDir {
+		dirMode, err := DirModeFor(opts)
+		if err != nil {
+			return err
+		}
+		backupDir := filepath.Dir(backupPath)
+		if needsSudo {
+			err = priv.Mkdir(backupDir, dirMode)
+		} else {
+			err = os.MkdirAll(backupDir, dirMode)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create backup directory: %w", err)
+		}
+	}
+
+	var err error
+	if needsSudo {
+		err = priv.Move(target, backupPath)
+	} else {
+		err = os.Rename(target, backupPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move directory %s aside: %w", target, err)
+	}
+	sm.backups[target] = backupPath
+	if sm.verbose {
+		logf(opts, "[BACKUP] %s -> %s\n", target, backupPath)
+	}
+	return nil
 }
 
 // IsSymlink checks if path is a symlink
@@ -39,6 +155,16 @@ func ReadSymlink(path string) (string, error) {
 	return os.Readlink(path)
 }
 
+// ResolveLinkDest resolves a symlink destination as returned by Readlink
+// into a clean absolute path. Relative destinations are interpreted
+// relative to the directory containing the link.
+func ResolveLinkDest(link, dest string) string {
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(link), dest)
+	}
+	return filepath.Clean(dest)
+}
+
 // IsCorrectSymlink checks if target already points to source
 func IsCorrectSymlink(target, source string) bool {
 	isLink, err := IsSymlink(target)
@@ -64,9 +190,17 @@ func FileExists(path string) bool {
 }
 
 // isDirWritable checks if the directory containing the target path is writable
-// by attempting to create a temporary file in that directory
+// by attempting to create a temporary file in that directory. When the
+// directory does not exist yet, its nearest existing ancestor is checked,
+// since that is where the missing parents will be created.
 func isDirWritable(target string) bool {
 	dir := filepath.Dir(target)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
 	// Try to create a test file to check write permission
 	testFile := filepath.Join(dir, ".cdm-write-test-"+time.Now().Format("20060102150405.000"))
 	err := os.WriteFile(testFile, []byte{}, 0644)
@@ -79,35 +213,80 @@ func isDirWritable(target string) bool {
 
 // CreateSymlink creates a symlink with backup and sudo support
 func (sm *SymlinkManager) CreateSymlink(target, source string, opts types.ApplyOptions) error {
+	return sm.createLink(target, source, false, opts)
+}
+
+// createLink replaces target with a symlink (or, with hard set, a hard link)
+// to source, handling frozen mode, backups, sudo and dry-run
+func (sm *SymlinkManager) createLink(target, source string, hard bool, opts types.ApplyOptions) error {
 	// Check if already correct
-	if IsCorrectSymlink(target, source) {
+	correct := IsCorrectSymlink(target, source)
+	if hard {
+		correct = IsSameFile(target, source)
+	}
+	if correct {
 		if sm.verbose {
-			fmt.Printf("[SKIP] Already linked: %s -> %s\n", target, source)
+			logf(opts, "[SKIP] Already linked: %s -> %s\n", target, source)
 		}
 		return nil
 	}
 
+	// Frozen mode never touches existing targets
+	if opts.Frozen {
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("%w: refusing to replace existing target %s", ErrFrozen, target)
+		}
+	}
+
 	// Proactively check if we need sudo (directory writeability check)
 	// This matches the bash version's: [[ -w "$(dirname "$target")" ]]
 	needsSudo := !isDirWritable(target)
+	priv, err := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+	if err != nil {
+		return err
+	}
 	if needsSudo && sm.verbose {
-		fmt.Printf("[SUDO] Directory not writable, will use sudo for: %s\n", target)
+		logf(opts, "[SUDO] Directory not writable, will use %s for: %s\n", priv.Name(), target)
+	}
+
+	// A directory in place of a file target cannot be removed with os.Remove
+	if IsDirConflict(target, source) {
+		if err := sm.moveDirAside(target, needsSudo, priv, opts); err != nil {
+			return err
+		}
+		if opts.DryRun {
+			logf(opts, "[DRY-RUN] Would link: %s -> %s\n", target, source)
+			return nil
+		}
 	}
 
 	// Backup existing file if requested
 	if opts.Backup && FileExists(target) {
 		isLink, _ := IsSymlink(target)
 		if !isLink {
-			backupPath := target + ".backup." + time.Now().Format("20060102_150405")
-			if !opts.DryRun {
-				if err := copyFile(target, backupPath); err != nil {
-					return fmt.Errorf("failed to backup %s: %w", target, err)
-				}
+			if err := sm.backupFile(target, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Swap an existing target for the new symlink atomically so readers never
+	// see it missing; fall back to remove and create when the rename is not
+	// possible (e.g. an empty directory in the way) or needs sudo
+	if !hard && !needsSudo {
+		if info, err := os.Lstat(target); err == nil && opts.DryRun && !info.IsDir() {
+			logf(opts, "[DRY-RUN] Would replace atomically: %s -> %s\n", target, source)
+			return nil
+		} else if err == nil && !opts.DryRun {
+			err := replaceSymlink(target, source)
+			if err == nil {
 				if sm.verbose {
-					fmt.Printf("[BACKUP] %s -> %s\n", target, backupPath)
+					logf(opts, "[LINK] %s -> %s (replaced atomically)\n", target, source)
 				}
-			} else {
-				fmt.Printf("[DRY-RUN] Would backup: %s -> %s\n", target, backupPath)
+				return nil
+			}
+			if sm.verbose {
+				logf(opts, "[INFO] Cannot replace %s atomically, removing it first: %s\n", target, err)
 			}
 		}
 	}
@@ -118,7 +297,7 @@ func (sm *SymlinkManager) CreateSymlink(target, source string, opts types.ApplyO
 			var err error
 			if needsSudo {
 				// Use sudo proactively when directory is not writable
-				err = removeWithSudo(target)
+				err = priv.Remove(target)
 			} else {
 				err = os.Remove(target)
 			}
@@ -126,41 +305,48 @@ func (sm *SymlinkManager) CreateSymlink(target, source string, opts types.ApplyO
 				return fmt.Errorf("failed to remove %s: %w", target, err)
 			}
 			if sm.verbose {
-				fmt.Printf("[REMOVE] %s\n", target)
+				logf(opts, "[REMOVE] %s\n", target)
 			}
 		} else {
-			fmt.Printf("[DRY-RUN] Would remove: %s\n", target)
+			logf(opts, "[DRY-RUN] Would remove: %s\n", target)
 		}
 	}
 
 	// Create parent directory
 	targetDir := filepath.Dir(target)
+	dirMode, err := DirModeFor(opts)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
 		if !opts.DryRun {
 			var err error
 			if needsSudo {
 				// Use sudo proactively when directory is not writable
-				err = mkdirWithSudo(targetDir)
+				err = priv.Mkdir(targetDir, dirMode)
 			} else {
-				err = os.MkdirAll(targetDir, 0755)
+				err = os.MkdirAll(targetDir, dirMode)
 			}
 			if err != nil {
 				return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
 			}
 			if sm.verbose {
-				fmt.Printf("[MKDIR] %s\n", targetDir)
+				logf(opts, "[MKDIR] %s\n", targetDir)
 			}
 		} else {
-			fmt.Printf("[DRY-RUN] Would create directory: %s\n", targetDir)
+			logf(opts, "[DRY-RUN] Would create directory: %s\n", targetDir)
 		}
 	}
 
 	// Create symlink
+	if hard {
+		return sm.hardlink(target, source, needsSudo, priv, opts)
+	}
 	if !opts.DryRun {
 		var err error
 		if needsSudo {
 			// Use sudo proactively when directory is not writable
-			err = symlinkWithSudo(target, source)
+			err = priv.Symlink(target, source)
 		} else {
 			err = os.Symlink(source, target)
 		}
@@ -168,15 +354,30 @@ func (sm *SymlinkManager) CreateSymlink(target, source string, opts types.ApplyO
 			return fmt.Errorf("failed to create symlink %s: %w", target, err)
 		}
 		if sm.verbose {
-			fmt.Printf("[LINK] %s -> %s\n", target, source)
+			logf(opts, "[LINK] %s -> %s\n", target, source)
 		}
 	} else {
-		fmt.Printf("[DRY-RUN] Would link: %s -> %s\n", target, source)
+		logf(opts, "[DRY-RUN] Would link: %s -> %s\n", target, source)
 	}
 
 	return nil
 }
 
+// replaceSymlink replaces target with a symlink to source by creating the
+// link under a temporary name in the same directory and renaming it over
+// the target
+func replaceSymlink(target, source string) error {
+	tmp := filepath.Join(filepath.Dir(target), fmt.Sprintf(".%s.cdm-%d-%d", filepath.Base(target), os.Getpid(), time.Now().UnixNano()))
+	if err := os.Symlink(source, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 // copyFile copies a file to a new location
 func copyFile(src, dst string) error {
 	data, err := os.ReadFile(src)
@@ -194,9 +395,38 @@ func copyFile(src, dst string) error {
 
 // CopyFile copies a source file to target with backup, sudo, and dry-run support
 func (sm *SymlinkManager) CopyFile(target, source string, opts types.ApplyOptions) error {
+	// Identical content is already up to date; frozen mode never
+	// overwrites anything else
+	if _, err := os.Lstat(target); err == nil {
+		if match, err := FileContentsMatch(source, target); err == nil && match {
+			if sm.verbose {
+				logf(opts, "[SKIP] Already up to date: %s\n", target)
+			}
+			return nil
+		}
+		if opts.Frozen {
+			return fmt.Errorf("%w: refusing to overwrite existing target %s", ErrFrozen, target)
+		}
+	}
+
 	needsSudo := !isDirWritable(target)
+	priv, err := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+	if err != nil {
+		return err
+	}
 	if needsSudo && sm.verbose {
-		fmt.Printf("[SUDO] Directory not writable, will use sudo for: %s\n", target)
+		logf(opts, "[SUDO] Directory not writable, will use %s for: %s\n", priv.Name(), target)
+	}
+
+	// A directory in place of the target would receive the copy inside it
+	if IsDirConflict(target, source) {
+		if err := sm.moveDirAside(target, needsSudo, priv, opts); err != nil {
+			return err
+		}
+		if opts.DryRun {
+			logf(opts, "[DRY-RUN] Would copy: %s -> %s\n", source, target)
+			return nil
+		}
 	}
 
 	// Backup existing file if requested
@@ -204,16 +434,8 @@ func (sm *SymlinkManager) CopyFile(target, source string, opts types.ApplyOption
 		isLink, _ := IsSymlink(target)
 		if !isLink {
 			if _, err := os.Lstat(target); err == nil {
-				backupPath := target + ".backup." + time.Now().Format("20060102_150405")
-				if !opts.DryRun {
-					if err := copyFile(target, backupPath); err != nil {
-						return fmt.Errorf("failed to backup %s: %w", target, err)
-					}
-					if sm.verbose {
-						fmt.Printf("[BACKUP] %s -> %s\n", target, backupPath)
-					}
-				} else {
-					fmt.Printf("[DRY-RUN] Would backup: %s -> %s\n", target, backupPath)
+				if err := sm.backupFile(target, opts); err != nil {
+					return err
 				}
 			}
 		}
@@ -221,22 +443,26 @@ func (sm *SymlinkManager) CopyFile(target, source string, opts types.ApplyOption
 
 	// Create parent directory
 	targetDir := filepath.Dir(target)
+	dirMode, err := DirModeFor(opts)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
 		if !opts.DryRun {
 			var err error
 			if needsSudo {
-				err = mkdirWithSudo(targetDir)
+				err = priv.Mkdir(targetDir, dirMode)
 			} else {
-				err = os.MkdirAll(targetDir, 0755)
+				err = os.MkdirAll(targetDir, dirMode)
 			}
 			if err != nil {
 				return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
 			}
 			if sm.verbose {
-				fmt.Printf("[MKDIR] %s\n", targetDir)
+				logf(opts, "[MKDIR] %s\n", targetDir)
 			}
 		} else {
-			fmt.Printf("[DRY-RUN] Would create directory: %s\n", targetDir)
+			logf(opts, "[DRY-RUN] Would create directory: %s\n", targetDir)
 		}
 	}
 
@@ -244,7 +470,7 @@ func (sm *SymlinkManager) CopyFile(target, source string, opts types.ApplyOption
 	if !opts.DryRun {
 		var err error
 		if needsSudo {
-			err = copyWithSudo(target, source)
+			err = priv.Copy(target, source)
 		} else {
 			err = copyFile(source, target)
 		}
@@ -252,22 +478,86 @@ func (sm *SymlinkManager) CopyFile(target, source string, opts types.ApplyOption
 			return fmt.Errorf("failed to copy %s -> %s: %w", source, target, err)
 		}
 		if sm.verbose {
-			fmt.Printf("[COPY] %s -> %s\n", source, target)
+			logf(opts, "[COPY] %s -> %s\n", source, target)
 		}
 	} else {
-		fmt.Printf("[DRY-RUN] Would copy: %s -> %s\n", source, target)
+		logf(opts, "[DRY-RUN] Would copy: %s -> %s\n", source, target)
 	}
 
 	return nil
 }
 
-// copyWithSudo copies a file using sudo
-func copyWithSudo(target, source string) error {
-	cmd := exec.Command("sudo", "cp", source, target)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// IsOwnedSymlink checks if target is a symlink pointing at source,
+// accepting both absolute and relative link destinations
+func IsOwnedSymlink(target, source string) bool {
+	isLink, err := IsSymlink(target)
+	if err != nil || !isLink {
+		return false
+	}
+
+	dest, err := ReadSymlink(target)
+	if err != nil {
+		return false
+	}
+
+	return SamePath(ResolveLinkDest(target, dest), filepath.Clean(source))
+}
+
+// RemoveSymlink removes a symlink with sudo and dry-run support
+func (sm *SymlinkManager) RemoveSymlink(target string, opts types.ApplyOptions) error {
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would remove: %s\n", target)
+		return nil
+	}
+
+	var err error
+	if isDirWritable(target) {
+		err = os.Remove(target)
+	} else {
+		priv, perr := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+		if perr != nil {
+			return perr
+		}
+		if sm.verbose {
+			logf(opts, "[SUDO] Directory not writable, will use %s for: %s\n", priv.Name(), target)
+		}
+		err = priv.Remove(target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", target, err)
+	}
+
+	if sm.verbose {
+		logf(opts, "[REMOVE] %s\n", target)
+	}
+	return nil
+}
+
+// RestoreBackup replaces target with a backup made before it was replaced
+func (sm *SymlinkManager) RestoreBackup(target, backup string, opts types.ApplyOptions) error {
+	if opts.DryRun {
+		logf(opts, "[DRY-RUN] Would restore: %s -> %s\n", backup, target)
+		return nil
+	}
+
+	if err := sm.RemoveSymlink(target, opts); err != nil {
+		return err
+	}
+
+	var err error
+	if isDirWritable(target) {
+		err = os.Rename(backup, target)
+	} else {
+		priv, perr := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+		if perr != nil {
+			return perr
+		}
+		err = priv.Move(backup, target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore %s from %s: %w", target, backup, err)
+	}
+	return nil
 }
 
 // FileContentsMatch checks if two files have identical content
@@ -283,33 +573,6 @@ func FileContentsMatch(a, b string) (bool, error) {
 	return string(dataA) == string(dataB), nil
 }
 
-// removeWithSudo removes a file using sudo (with terminal access)
-func removeWithSudo(path string) error {
-	cmd := exec.Command("sudo", "rm", "-f", path)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
-// symlinkWithSudo creates a symlink using sudo (with terminal access)
-func symlinkWithSudo(target, source string) error {
-	cmd := exec.Command("sudo", "ln", "-sf", source, target)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
-// mkdirWithSudo creates directory using sudo (with terminal access)
-func mkdirWithSudo(path string) error {
-	cmd := exec.Command("sudo", "mkdir", "-p", path)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 // ExpandPath expands ~ to home directory
 func ExpandPath(path string) (string, error) {
 	if strings.HasPrefix(path, "~") {
@@ -322,6 +585,15 @@ func ExpandPath(path string) (string, error) {
 	return path, nil
 }
 
+// InHome reports whether path is inside the user's home directory
+func InHome(path string) bool {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return false
+	}
+	return path == home || strings.HasPrefix(path, home+string(filepath.Separator))
+}
+
 // NeedsSudo checks if a path requires sudo privileges
 // Returns true if path is under system directories
 func NeedsSudo(path string) bool {
@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// errXattrUnsupported is returned on platforms without extended attributes
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// sortedXattrNames returns the attribute names of want in order, for
+// stable output
+func sortedXattrNames(want map[string]string) []string {
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckXattrs compares the extended attributes of path (not following a
+// symlink) with the expected values. Returns a description of the drift
+// and false on mismatch.
+func CheckXattrs(path string, want map[string]string) (string, bool) {
+	var drift []string
+	for _, name := range sortedXattrNames(want) {
+		got, ok, err := GetXattr(path, name)
+		switch {
+		case err != nil:
+			drift = append(drift, fmt.Sprintf("failed to read %s: %v", name, err))
+		case !ok:
+			drift = append(drift, fmt.Sprintf("%s is not set, expected %q", name, want[name]))
+		case got != want[name]:
+			drift = append(drift, fmt.Sprintf("%s is %q, expected %q", name, got, want[name]))
+		}
+	}
+	if len(drift) > 0 {
+		return strings.Join(drift, "; "), false
+	}
+	return "", true
+}
+
+// EnsureXattrs sets the extended attributes of path (not following a
+// symlink) that differ from the expected values. Returns true if any was
+// (or would be, in dry-run) changed.
+func (sm *SymlinkManager) EnsureXattrs(path string, want map[string]string, opts types.ApplyOptions) (bool, error) {
+	changed := false
+	for _, name := range sortedXattrNames(want) {
+		value := want[name]
+		if got, ok, err := GetXattr(path, name); err == nil && ok && got == value {
+			continue
+		}
+		changed = true
+
+		if opts.DryRun {
+			logf(opts, "[DRY-RUN] Would set xattr %s on %s: %q\n", name, path, value)
+			continue
+		}
+
+		err := setXattr(path, name, value)
+		// Escalating cannot help root, e.g. with user.* attributes on a symlink
+		if errors.Is(err, os.ErrPermission) && !IsRoot() {
+			priv, perr := NewPrivileged(opts.PrivilegeTool, opts.Timeout)
+			if perr != nil {
+				return changed, perr
+			}
+			if sm.verbose {
+				logf(opts, "[SUDO] Permission denied, will use %s to set xattr: %s\n", priv.Name(), path)
+			}
+			err = priv.SetXattr(path, name, value)
+		}
+		if err != nil {
+			return changed, fmt.Errorf("failed to set xattr %s on %s: %w", name, path, err)
+		}
+		logf(opts, "[XATTR] %s: %s=%q\n", path, name, value)
+	}
+	return changed, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package fs
+
+// GetXattr reads an extended attribute of path itself. Extended attributes
+// are not supported on this platform.
+func GetXattr(path, name string) (string, bool, error) {
+	return "", false, errXattrUnsupported
+}
+
+// setXattr sets an extended attribute of path itself. Extended attributes
+// are not supported on this platform.
+func setXattr(path, name, value string) error {
+	return errXattrUnsupported
+}
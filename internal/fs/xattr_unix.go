@@ -0,0 +1,52 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// GetXattr reads an extended attribute of path itself, not following a
+// symlink. Returns false without error if the attribute is not set. A
+// trailing NUL, as the kernel stores SELinux contexts, is dropped.
+func GetXattr(path, name string) (string, bool, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err == nil {
+		buf := make([]byte, size)
+		var n int
+		if n, err = unix.Lgetxattr(path, name, buf); err == nil {
+			return strings.TrimSuffix(string(buf[:n]), "\x00"), true, nil
+		}
+	}
+	// The "not set" errno differs between platforms (ENODATA, ENOATTR)
+	if set, lerr := hasXattr(path, name); lerr == nil && !set {
+		return "", false, nil
+	}
+	return "", false, err
+}
+
+// hasXattr reports whether path itself has the named extended attribute
+func hasXattr(path, name string) (bool, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return false, err
+	}
+	buf := make([]byte, size)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil {
+		return false, err
+	}
+	for _, listed := range strings.Split(string(buf[:n]), "\x00") {
+		if listed == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setXattr sets an extended attribute of path itself, not following a symlink
+func setXattr(path, name, value string) error {
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
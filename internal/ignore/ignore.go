@@ -0,0 +1,216 @@
+// Package ignore implements .gitignore pattern matching
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FileName is the name of the ignore files honored by the matcher
+const FileName = ".gitignore"
+
+// rule is a single parsed pattern line, scoped to the directory of its file
+type rule struct {
+	base     string // Directory containing the ignore file
+	re       *regexp.Regexp
+	negate   bool // "!pattern" re-includes a previously ignored path
+	dirOnly  bool // "pattern/" only matches directories
+	anchored bool // Pattern contains a slash: matched against the path relative to base
+}
+
+// Matcher holds the rules of every loaded ignore file
+type Matcher struct {
+	rules  []rule
+	loaded map[string]bool
+}
+
+// New creates an empty matcher
+func New() *Matcher {
+	return &Matcher{loaded: make(map[string]bool)}
+}
+
+// LoadParents loads the ignore files of dir and of each of its ancestors up
+// to the enclosing git repository root (or dir itself outside a repository),
+// shallowest first so deeper files take precedence.
+func (m *Matcher) LoadParents(dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	dirs := []string{absDir}
+	for cur := absDir; ; {
+		if _, err := os.Stat(filepath.Join(cur, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			// Not inside a repository: only the scanned directory's own file applies
+			dirs = dirs[:1]
+			break
+		}
+		dirs = append(dirs, parent)
+		cur = parent
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := m.LoadDir(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadDir loads the ignore file of a single directory, if present
+func (m *Matcher) LoadDir(dir string) error {
+	if m.loaded[dir] {
+		return nil
+	}
+	m.loaded[dir] = true
+
+	path := filepath.Join(dir, FileName)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok := parseRule(dir, scanner.Text()); ok {
+			m.rules = append(m.rules, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// parseRule parses one line of an ignore file
+func parseRule(base, line string) (rule, bool) {
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false
+	}
+
+	r := rule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule{}, false
+	}
+
+	re, err := GlobRegexp(line)
+	if err != nil {
+		return rule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// GlobRegexp compiles a glob with gitignore semantics into a regular
+// expression matching the whole path
+func GlobRegexp(glob string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^" + globToRegexp(glob) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", glob, err)
+	}
+	return re, nil
+}
+
+// globToRegexp converts a gitignore glob to a regular expression.
+// "*" and "?" do not cross "/", "**" matches any number of directories.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more leading directories
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// Ignored reports whether an absolute path is ignored. The last matching
+// rule wins; rules from deeper ignore files are loaded later and so
+// override shallower ones. Callers walking a tree should skip ignored
+// directories, as git does not re-include files under an ignored directory.
+func (m *Matcher) Ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(r.base, path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		subject := rel
+		if !r.anchored {
+			subject = filepath.Base(path)
+		}
+		if r.re.MatchString(subject) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,238 @@
+package plan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/woodgear/cdm/internal/config"
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// ExcludeCmdPlaceholder is replaced with the quoted source path in excludeCmd
+const ExcludeCmdPlaceholder = "{{path}}"
+
+// ExcludeCmdCacheFile caches excludeCmd results inside the cache dir
+const ExcludeCmdCacheFile = "exclude-cmd.json"
+
+// ExcludeCmdRule is an excludeCmd predicate scoped to the directory of the
+// config file that declared it
+type ExcludeCmdRule struct {
+	Dir     string // Config directory the rule applies under; the command runs here
+	Command string // Shell command; a non-zero exit excludes the file
+}
+
+// excludeCmdRulesFor returns the excludeCmd rules that apply to a source file
+func (s *Scanner) excludeCmdRulesFor(absPath string) []ExcludeCmdRule {
+	var rules []ExcludeCmdRule
+	for _, rule := range s.excludeCmds {
+		if strings.HasPrefix(absPath, rule.Dir+string(filepath.Separator)) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// command returns the shell command checking one file: the placeholder is
+// replaced with the quoted path, or the path is appended if there is none
+func (r ExcludeCmdRule) command(absPath string) string {
+	quoted := fs.ShellQuote(absPath)
+	if strings.Contains(r.Command, ExcludeCmdPlaceholder) {
+		return strings.ReplaceAll(r.Command, ExcludeCmdPlaceholder, quoted)
+	}
+	return r.Command + " " + quoted
+}
+
+// excludes runs the predicate for a file, killing it after timeout (0: no
+// limit). Returns true if it exited non-zero; failing to run the command at
+// all or a timeout is an error.
+func (r ExcludeCmdRule) excludes(absPath string, timeout time.Duration) (bool, error) {
+	// Predicates run concurrently: keep them off the terminal's stdin and
+	// keep their output out of plans written to stdout
+	script := "{ " + r.command(absPath) + "\n} </dev/null >&2"
+	err := fs.RunCommand(r.Dir, timeout, "sh", "-c", script)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to run excludeCmd in %s: %w", r.Dir, err)
+	}
+	return false, nil
+}
+
+// excludeCmdCache remembers predicate results between runs, keyed by the
+// command and the file's path, size and modification time
+type excludeCmdCache struct {
+	mu      sync.Mutex
+	path    string
+	results map[string]bool // Key -> excluded
+	used    map[string]bool // Keys looked up or stored by this process
+	dirty   bool
+}
+
+// loadExcludeCmdCache reads the cache file; a missing or unreadable cache
+// starts empty
+func loadExcludeCmdCache() *excludeCmdCache {
+	c := &excludeCmdCache{results: make(map[string]bool), used: make(map[string]bool)}
+	dir, err := config.CacheDir()
+	if err != nil {
+		return c
+	}
+	c.path = filepath.Join(dir, ExcludeCmdCacheFile)
+	if data, err := os.ReadFile(c.path); err == nil {
+		json.Unmarshal(data, &c.results)
+	}
+	return c
+}
+
+// excludeCmdKey identifies a predicate result for one version of a file
+func excludeCmdKey(rule ExcludeCmdRule, absPath string, info os.FileInfo) string {
+	h := sha256.New()
+	for _, part := range []string{rule.Dir, rule.Command, absPath, strconv.FormatInt(info.Size(), 10), strconv.FormatInt(info.ModTime().UnixNano(), 10)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *excludeCmdCache) get(key string) (excluded, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	excluded, ok = c.results[key]
+	if ok {
+		c.used[key] = true
+	}
+	return excluded, ok
+}
+
+func (c *excludeCmdCache) put(key string, excluded bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[key] = excluded
+	c.used[key] = true
+	c.dirty = true
+}
+
+// save writes the results used by this process back, dropping entries
+// for files that changed or were not seen
+func (c *excludeCmdCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty || c.path == "" {
+		return nil
+	}
+	kept := make(map[string]bool, len(c.used))
+	for key := range c.used {
+		kept[key] = c.results[key]
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return fmt.Errorf("failed to marshal excludeCmd cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := os.WriteFile(c.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", c.path, err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// excludeCmdCandidate is a scanned file that excludeCmd predicates apply to
+type excludeCmdCandidate struct {
+	index int // Position in the scanned entries
+	info  os.FileInfo
+	rules []ExcludeCmdRule
+}
+
+// applyExcludeCmds runs the excludeCmd predicates of the candidates, at
+// most s.opts.Concurrency at a time, and drops the entries they exclude.
+// Returns the remaining entries and the number excluded.
+func (s *Scanner) applyExcludeCmds(entries []types.FileEntry, candidates []excludeCmdCandidate) ([]types.FileEntry, int, error) {
+	if len(candidates) == 0 {
+		return entries, 0, nil
+	}
+	if s.cmdCache == nil {
+		s.cmdCache = loadExcludeCmdCache()
+	}
+
+	workers := s.opts.Concurrency
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	excluded := make([]string, len(candidates)) // Command that excluded each candidate
+	errs := make([]error, len(candidates))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, cand := range candidates {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, cand excludeCmdCandidate) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			source := entries[cand.index].Source
+			for _, rule := range cand.rules {
+				key := excludeCmdKey(rule, source, cand.info)
+				out, ok := s.cmdCache.get(key)
+				if !ok {
+					var err error
+					if out, err = rule.excludes(source, s.opts.Timeout); err != nil {
+						errs[i] = err
+						return
+					}
+					s.cmdCache.put(key, out)
+				}
+				if out {
+					excluded[i] = rule.Command
+					return
+				}
+			}
+		}(i, cand)
+	}
+	wg.Wait()
+
+	if err := s.cmdCache.save(); err != nil && s.verbose {
+		fmt.Fprintf(os.Stderr, "[WARN] %s\n", err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	drop := make(map[int]string)
+	for i, cand := range candidates {
+		if excluded[i] != "" {
+			drop[cand.index] = excluded[i]
+		}
+	}
+	kept := entries[:0]
+	for i, entry := range entries {
+		command, ok := drop[i]
+		if !ok {
+			kept = append(kept, entry)
+			continue
+		}
+		if s.explain.concerns(entry.Target) {
+			s.explain.add("EXCLUDE", "%s is rejected by excludeCmd %q", entry.Source, command)
+		}
+		if s.verbose {
+			fmt.Printf("[EXCLUDE] %s (excludeCmd)\n", entry.Source)
+		}
+	}
+	return kept, len(drop), nil
+}
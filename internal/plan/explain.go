@@ -0,0 +1,39 @@
+package plan
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Explanation records the generation decisions that concern one target
+type Explanation struct {
+	Target string
+	Steps  []string
+}
+
+// SetExplain records the decisions affecting target during Generate,
+// available afterwards from Explanation
+func (g *Generator) SetExplain(target string) {
+	g.explain = &Explanation{Target: filepath.Clean(target)}
+	g.scanner.explain = g.explain
+}
+
+// Explanation returns the decisions recorded for the SetExplain target
+func (g *Generator) Explanation() *Explanation {
+	return g.explain
+}
+
+// concerns reports whether a decision about path (a file or a directory
+// containing files) affects the explained target
+func (e *Explanation) concerns(path string) bool {
+	if e == nil {
+		return false
+	}
+	return e.Target == path || strings.HasPrefix(e.Target, path+string(filepath.Separator))
+}
+
+// add records a decision as a tagged line
+func (e *Explanation) add(tag, format string, args ...interface{}) {
+	e.Steps = append(e.Steps, fmt.Sprintf("[%s] %s", tag, fmt.Sprintf(format, args...)))
+}
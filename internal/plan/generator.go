@@ -3,19 +3,32 @@ package plan
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/woodgear/cdm/internal/config"
 	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/internal/ignore"
+	"github.com/woodgear/cdm/internal/repo"
 	"github.com/woodgear/cdm/pkg/types"
 )
 
 // Scanner scans directories for config files
 type Scanner struct {
-	verbose bool
+	verbose     bool
+	opts        types.PlanOptions
+	hidden      []HiddenRule
+	extensions  []ExtensionRule
+	excludeCmds []ExcludeCmdRule
+	cmdCache    *excludeCmdCache
+	explain     *Explanation
+	denied      []string // Source paths the walk could not read
 }
 
 // NewScanner creates a new scanner
@@ -23,27 +36,47 @@ func NewScanner(verbose bool) *Scanner {
 	return &Scanner{verbose: verbose}
 }
 
+// inTimeWindow checks a modification time against --modified-after/--modified-before
+func (s *Scanner) inTimeWindow(modTime time.Time) bool {
+	if !s.opts.ModifiedAfter.IsZero() && !modTime.After(s.opts.ModifiedAfter) {
+		return false
+	}
+	if !s.opts.ModifiedBefore.IsZero() && !modTime.Before(s.opts.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
 // ScanDir scans a directory for files to link
-// baseType: "home" maps to $HOME, "root" maps to /
+// baseType: "home" maps to $HOME, "root" maps to /,
+// "flat" maps the source directory itself to $HOME
 // linkFolders: set of absolute paths that should be linked as folders
-func (s *Scanner) ScanDir(srcDir, baseType string, linkFolders map[string]bool) ([]types.FileEntry, error) {
+// excludes: rules for files and directories to leave out
+// Returns the entries found and the number of excluded or filtered entries.
+func (s *Scanner) ScanDir(srcDir, baseType string, linkFolders map[string]bool, excludes []ExcludeRule) ([]types.FileEntry, int, error) {
 	var entries []types.FileEntry
+	var skipped int
 
 	var basePath string
 	switch baseType {
-	case "home":
+	case "home", "flat":
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get home directory: %w", err)
+			return nil, 0, fmt.Errorf("failed to get home directory: %w", err)
 		}
 		basePath = home
 	case "root":
 		basePath = ""
 	default:
-		return nil, fmt.Errorf("invalid base type: %s", baseType)
+		return nil, 0, fmt.Errorf("invalid base type: %s", baseType)
 	}
 
-	scanPath := filepath.Join(srcDir, baseType)
+	// --strip-prefix: the bases live below a leading directory of the source
+	layoutDir := filepath.Join(srcDir, s.opts.StripPrefix)
+	scanPath := filepath.Join(layoutDir, baseType)
+	if baseType == "flat" {
+		scanPath = layoutDir
+	}
 
 	info, err := os.Stat(scanPath)
 	if err != nil {
@@ -51,25 +84,75 @@ func (s *Scanner) ScanDir(srcDir, baseType string, linkFolders map[string]bool)
 			if s.verbose {
 				fmt.Printf("[SKIP] Directory not found: %s\n", scanPath)
 			}
-			return entries, nil
+			return entries, 0, nil
 		}
-		return nil, fmt.Errorf("failed to stat %s: %w", scanPath, err)
+		return nil, 0, fmt.Errorf("failed to stat %s: %w", scanPath, err)
 	}
 
 	if !info.IsDir() {
-		return nil, fmt.Errorf("%s is not a directory", scanPath)
+		return nil, 0, fmt.Errorf("%s is not a directory", scanPath)
 	}
 
 	if s.verbose {
 		fmt.Printf("[SCAN] %s\n", scanPath)
 	}
 
+	// Restrict the walk to files changed since --since-commit
+	var changed, changedDirs map[string]bool
+	if s.opts.SinceCommit != "" {
+		files, err := repo.ChangedFiles(scanPath, s.opts.SinceCommit)
+		if err != nil {
+			return nil, 0, err
+		}
+		changed = make(map[string]bool, len(files))
+		changedDirs = make(map[string]bool)
+		for _, f := range files {
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to get absolute path: %w", err)
+			}
+			changed[abs] = true
+			for dir := filepath.Dir(abs); !changedDirs[dir] && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+				changedDirs[dir] = true
+			}
+		}
+		if s.verbose {
+			fmt.Printf("[INFO] %d files changed since %s in %s\n", len(files), s.opts.SinceCommit, scanPath)
+		}
+	}
+
+	var gitignore *ignore.Matcher
+	if s.opts.RespectGitignore {
+		gitignore = ignore.New()
+		if err := gitignore.LoadParents(scanPath); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Files checked by excludeCmd predicates once the walk is done
+	var cmdCandidates []excludeCmdCandidate
+
 	// Walk the directory tree
 	err = filepath.Walk(scanPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			// Note unreadable paths and keep scanning everything else
+			if os.IsPermission(err) && path != scanPath {
+				skipped++
+				absPath, _ := filepath.Abs(path)
+				s.denied = append(s.denied, absPath)
+				if s.verbose {
+					fmt.Printf("[SKIP] Permission denied: %s\n", absPath)
+				}
+				return nil
+			}
 			return err
 		}
 
+		// A flat source is usually the repo root; never link its git metadata
+		if baseType == "flat" && info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
 		// Get relative path
 		relPath, err := filepath.Rel(scanPath, path)
 		if err != nil {
@@ -90,10 +173,75 @@ func (s *Scanner) ScanDir(srcDir, baseType string, linkFolders map[string]bool)
 			return fmt.Errorf("failed to get absolute path: %w", err)
 		}
 
+		// Skip excluded files and directories
+		if path != scanPath && IsExcluded(excludes, absSource) {
+			skipped++
+			if s.explain.concerns(targetPath) {
+				s.explain.add("EXCLUDE", "%s matches an exclude rule", absSource)
+			}
+			if s.verbose {
+				fmt.Printf("[EXCLUDE] %s\n", absSource)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip hidden entries according to includeHidden/excludeNestedHidden
+		if path != scanPath && s.isHiddenExcluded(absSource, relPath) {
+			skipped++
+			if s.explain.concerns(targetPath) {
+				s.explain.add("HIDDEN", "%s is hidden by includeHidden/excludeNestedHidden", absSource)
+			}
+			if s.verbose {
+				fmt.Printf("[HIDDEN] %s\n", absSource)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip whole unchanged subtrees and unchanged files
+		if changed != nil && path != scanPath {
+			if info.IsDir() && !changedDirs[absSource] {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && !changed[absSource] {
+				return nil
+			}
+		}
+
+		// Skip files ignored by git, loading nested .gitignore files as we descend
+		if gitignore != nil && path != scanPath {
+			if gitignore.Ignored(absSource, info.IsDir()) {
+				skipped++
+				if s.explain.concerns(targetPath) {
+					s.explain.add("IGNORE", "%s is ignored by .gitignore", absSource)
+				}
+				if s.verbose {
+					fmt.Printf("[IGNORE] %s\n", absSource)
+				}
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if err := gitignore.LoadDir(absSource); err != nil {
+					return err
+				}
+			}
+		}
+
 		// Check if this path is under a linkFolder
 		for folderPath := range linkFolders {
 			// If this path is a linkFolder itself
 			if absSource == folderPath && info.IsDir() {
+				if s.explain.concerns(targetPath) {
+					s.explain.add("FOUND", "layer %s: %s (folder link)", filepath.Base(srcDir), absSource)
+				}
 				// Add folder link entry
 				entries = append(entries, types.FileEntry{
 					Source:     absSource,
@@ -118,11 +266,77 @@ func (s *Scanner) ScanDir(srcDir, baseType string, linkFolders map[string]bool)
 			}
 		}
 
-		// Skip directories (they're handled via linkFolders or files inside)
+		// Skip directories (they're handled via linkFolders or files inside),
+		// except empty ones when their structure should be mirrored
 		if info.IsDir() {
+			if s.opts.IncludeEmptyDirs && path != scanPath && isEmptyDir(path) {
+				if s.explain.concerns(targetPath) {
+					s.explain.add("FOUND", "layer %s: %s (empty directory)", filepath.Base(srcDir), absSource)
+				}
+				entries = append(entries, types.FileEntry{
+					Source:     absSource,
+					Target:     targetPath,
+					SourcePath: srcDir,
+					Reason:     "new",
+					EmptyDir:   true,
+				})
+				if s.verbose {
+					fmt.Printf("[EMPTY_DIR] %s -> %s\n", absSource, targetPath)
+				}
+			}
+			return nil
+		}
+
+		// Config files placed in subdirectories are not dotfiles
+		if info.Name() == config.ConfigFileName {
 			return nil
 		}
 
+		// Skip dangling symlinks in the source so broken references
+		// don't propagate into the target
+		if info.Mode()&os.ModeSymlink != 0 {
+			if _, err := os.Stat(path); err != nil {
+				skipped++
+				dest, _ := os.Readlink(path)
+				if s.explain.concerns(targetPath) {
+					s.explain.add("SKIP", "%s is a dangling symlink to %s", absSource, dest)
+				}
+				fmt.Fprintf(os.Stderr, "[WARN] Skipping dangling symlink in source: %s -> %s\n", absSource, dest)
+				return nil
+			}
+		}
+
+		// Skip files with an extension listed in excludeExtensions
+		if ext, ok := s.excludedExtension(absSource); ok {
+			skipped++
+			if s.explain.concerns(targetPath) {
+				s.explain.add("EXCLUDE", "%s matches excludeExtensions %s", absSource, ext)
+			}
+			if s.verbose {
+				fmt.Printf("[EXCLUDE] %s (excludeExtensions %s)\n", absSource, ext)
+			}
+			return nil
+		}
+
+		// Skip files outside the modification time window
+		if !s.inTimeWindow(info.ModTime()) {
+			skipped++
+			if s.explain.concerns(targetPath) {
+				s.explain.add("SKIP", "%s is outside the modification window", absSource)
+			}
+			if s.verbose {
+				fmt.Printf("[SKIP] Outside modification window: %s\n", absSource)
+			}
+			return nil
+		}
+
+		if rules := s.excludeCmdRulesFor(absSource); len(rules) > 0 {
+			cmdCandidates = append(cmdCandidates, excludeCmdCandidate{index: len(entries), info: info, rules: rules})
+		}
+
+		if s.explain.concerns(targetPath) {
+			s.explain.add("FOUND", "layer %s: %s", filepath.Base(srcDir), absSource)
+		}
 		entries = append(entries, types.FileEntry{
 			Source:     absSource,
 			Target:     targetPath,
@@ -134,17 +348,159 @@ func (s *Scanner) ScanDir(srcDir, baseType string, linkFolders map[string]bool)
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to walk directory %s: %w", scanPath, err)
+		return nil, 0, fmt.Errorf("failed to walk directory %s: %w", scanPath, err)
+	}
+
+	entries, cmdExcluded, err := s.applyExcludeCmds(entries, cmdCandidates)
+	if err != nil {
+		return nil, 0, err
 	}
+	skipped += cmdExcluded
+
+	return entries, skipped, nil
+}
 
-	return entries, nil
+// isEmptyDir reports whether a directory has no entries at all
+func isEmptyDir(path string) bool {
+	entries, err := os.ReadDir(path)
+	return err == nil && len(entries) == 0
+}
+
+// LayoutFlat is the config layout value for sources without home/root subdirectories
+const LayoutFlat = "flat"
+
+// Base names accepted by --base
+const (
+	BaseHome = "home"
+	BaseRoot = "root"
+	BaseAll  = "all"
+)
+
+// InBase reports whether a target belongs to a base: "home" for targets
+// inside $HOME, "root" for everything else. "all" and "" match any target.
+func InBase(target, base string) bool {
+	switch base {
+	case BaseHome:
+		return fs.InHome(target)
+	case BaseRoot:
+		return !fs.InHome(target)
+	}
+	return true
+}
+
+// ExcludeRule is an exclude pattern scoped to the directory of the
+// config file that declared it
+type ExcludeRule struct {
+	Dir     string // Config directory the pattern applies under
+	Pattern string // Glob matched against the base name or the path relative to Dir
+}
+
+// IsExcluded checks if an absolute path matches any exclude rule
+func IsExcluded(rules []ExcludeRule, path string) bool {
+	for _, rule := range rules {
+		if !strings.HasPrefix(path, rule.Dir+string(filepath.Separator)) {
+			continue
+		}
+		if ok, _ := filepath.Match(rule.Pattern, filepath.Base(path)); ok {
+			return true
+		}
+		rel, err := filepath.Rel(rule.Dir, path)
+		if err != nil {
+			continue
+		}
+		if ok, _ := filepath.Match(rule.Pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HiddenRule is a hidden-file visibility setting scoped to the directory of
+// the config file that declared it
+type HiddenRule struct {
+	Dir        string // Config directory the rule applies under
+	NestedOnly bool   // Only hidden entries below the top level of the scan base
+}
+
+// isHiddenExcluded checks if a hidden entry is skipped by any hidden rule.
+// relPath is the entry's path relative to the scanned base (home/, root/
+// or the flat source root); top-level entries have no separator in it.
+func (s *Scanner) isHiddenExcluded(absPath, relPath string) bool {
+	if !strings.HasPrefix(filepath.Base(absPath), ".") {
+		return false
+	}
+	topLevel := !strings.Contains(relPath, string(filepath.Separator))
+	for _, rule := range s.hidden {
+		if !strings.HasPrefix(absPath, rule.Dir+string(filepath.Separator)) {
+			continue
+		}
+		if !rule.NestedOnly || !topLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtensionRule is an excluded file extension scoped to the directory of
+// the config file that declared it
+type ExtensionRule struct {
+	Dir string // Config directory the rule applies under
+	Ext string // Lowercase extension including the leading dot, e.g. ".orig"
+}
+
+// newExtensionRule normalizes a configured extension: "orig", ".orig" and
+// ".ORIG" are equivalent
+func newExtensionRule(dir, ext string) ExtensionRule {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ExtensionRule{Dir: dir, Ext: ext}
+}
+
+// excludedExtension returns the excludeExtensions entry a file name ends
+// with, compared case-insensitively. Multi-part extensions such as
+// ".tar.gz" are matched as suffixes.
+func (s *Scanner) excludedExtension(absPath string) (string, bool) {
+	name := strings.ToLower(filepath.Base(absPath))
+	for _, rule := range s.extensions {
+		if !strings.HasPrefix(absPath, rule.Dir+string(filepath.Separator)) {
+			continue
+		}
+		if strings.HasSuffix(name, rule.Ext) {
+			return rule.Ext, true
+		}
+	}
+	return "", false
 }
 
 // Generator generates execution plans
 type Generator struct {
 	verbose      bool
+	opts         types.PlanOptions
 	scanner      *Scanner
 	configLoader *config.Loader
+	explain      *Explanation
+}
+
+// reportDenied warns about the source paths the scan could not read, or
+// fails with --strict
+func (g *Generator) reportDenied() error {
+	denied := g.scanner.denied
+	if len(denied) == 0 {
+		return nil
+	}
+	tag := "[WARN]"
+	if g.opts.Strict {
+		tag = "[ERROR]"
+	}
+	for _, path := range denied {
+		fmt.Fprintf(os.Stderr, "%s Permission denied, not planned: %s\n", tag, path)
+	}
+	if g.opts.Strict {
+		return fmt.Errorf("%d source paths could not be read (--strict)", len(denied))
+	}
+	return nil
 }
 
 // NewGenerator creates a new plan generator
@@ -156,6 +512,25 @@ func NewGenerator(verbose bool) *Generator {
 	}
 }
 
+// SetOptions sets the plan generation options
+func (g *Generator) SetOptions(opts types.PlanOptions) {
+	g.opts = opts
+	g.scanner.opts = opts
+}
+
+// rebaseTarget moves a target under the alternate root, if one is set.
+// Home targets are only moved when RootHome is set.
+func (g *Generator) rebaseTarget(target, home string) string {
+	if g.opts.Root == "" || g.opts.Root == "/" {
+		return target
+	}
+	if !g.opts.RootHome && home != "" &&
+		(target == home || strings.HasPrefix(target, home+string(filepath.Separator))) {
+		return target
+	}
+	return filepath.Join(g.opts.Root, target)
+}
+
 // Generate generates an execution plan from source paths
 func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 	if g.verbose {
@@ -179,21 +554,32 @@ func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 			return nil, fmt.Errorf("source path is not a directory: %s", absPath)
 		}
 
+		if g.opts.StripPrefix != "" {
+			if info, err := os.Stat(filepath.Join(absPath, g.opts.StripPrefix)); err != nil || !info.IsDir() {
+				fmt.Fprintf(os.Stderr, "[WARN] Prefix %s not found in source: %s\n", g.opts.StripPrefix, absPath)
+			}
+		}
+
 		resolvedPaths = append(resolvedPaths, absPath)
 	}
 
 	// Load configurations first (to get linkFolders)
-	configs, err := g.configLoader.LoadAll(resolvedPaths)
+	configs, err := g.configLoader.LoadAll(resolvedPaths, g.opts.SourceConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configurations: %w", err)
 	}
 
+	// Drop rules whose when predicate does not hold in this environment
+	for configPath, cfg := range configs {
+		configs[configPath] = g.activeRules(configPath, cfg)
+	}
+
 	// Build linkFolders set from all configs
 	linkFolders := make(map[string]bool)
 	for configPath, cfg := range configs {
 		for _, folder := range cfg.LinkFolders {
 			// Resolve folder path relative to config location
-			folderAbsPath := filepath.Join(configPath, folder)
+			folderAbsPath := filepath.Join(configPath, folder.Value)
 			linkFolders[folderAbsPath] = true
 			if g.verbose {
 				fmt.Printf("[LINK_FOLDER] %s\n", folderAbsPath)
@@ -201,6 +587,33 @@ func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 		}
 	}
 
+	// mergeFolders directories are linked file by file in every layer, so
+	// a linkFolders entry for the same directory (or one below it) in any
+	// layer no longer replaces the files of the other layers
+	var mergeFolders []string
+	for configPath, cfg := range configs {
+		for _, folder := range cfg.MergeFolders {
+			if rel, ok := g.layerRelPath(resolvedPaths, configs, filepath.Join(configPath, folder.Value)); ok {
+				mergeFolders = append(mergeFolders, rel)
+			}
+		}
+	}
+	for folderPath := range linkFolders {
+		rel, ok := g.layerRelPath(resolvedPaths, configs, folderPath)
+		if !ok {
+			continue
+		}
+		for _, merged := range mergeFolders {
+			if _, under := underPath(rel, merged); under {
+				delete(linkFolders, folderPath)
+				if g.verbose {
+					fmt.Printf("[MERGE_FOLDER] %s (linked file by file)\n", folderPath)
+				}
+				break
+			}
+		}
+	}
+
 	// Collect all repos from configs
 	var allRepos []types.RepoConfig
 	for configPath, cfg := range configs {
@@ -217,42 +630,129 @@ func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 		}
 	}
 
+	// Collect exclude rules from all configs
+	var excludes []ExcludeRule
+	for configPath, cfg := range configs {
+		for _, pattern := range cfg.Exclude {
+			excludes = append(excludes, ExcludeRule{Dir: configPath, Pattern: pattern.Value})
+		}
+	}
+
+	// Collect hidden-file rules from all configs
+	g.scanner.hidden = nil
+	for configPath, cfg := range configs {
+		if cfg.IncludeHidden != nil && !*cfg.IncludeHidden {
+			g.scanner.hidden = append(g.scanner.hidden, HiddenRule{Dir: configPath})
+		} else if cfg.ExcludeNestedHidden {
+			g.scanner.hidden = append(g.scanner.hidden, HiddenRule{Dir: configPath, NestedOnly: true})
+		}
+	}
+
+	// Collect excluded extensions from all configs
+	g.scanner.extensions = nil
+	for configPath, cfg := range configs {
+		for _, ext := range cfg.ExcludeExtensions {
+			if strings.Trim(ext, ".") == "" {
+				continue
+			}
+			g.scanner.extensions = append(g.scanner.extensions, newExtensionRule(configPath, ext))
+		}
+	}
+
+	// Collect excludeCmd predicates from all configs
+	g.scanner.excludeCmds = nil
+	for configPath, cfg := range configs {
+		if strings.TrimSpace(cfg.ExcludeCmd) != "" {
+			// Source configs can come from remote repositories; running
+			// their shell commands needs the user's consent
+			if !g.opts.AllowExcludeCmd {
+				return nil, fmt.Errorf("%s sets excludeCmd %q; pass --allow-exclude-cmd (or set CDM_ALLOW_EXCLUDE_CMD=1) to run it",
+					filepath.Join(configPath, config.ConfigFileName), cfg.ExcludeCmd)
+			}
+			g.scanner.excludeCmds = append(g.scanner.excludeCmds, ExcludeCmdRule{Dir: configPath, Command: cfg.ExcludeCmd})
+		}
+	}
+	sort.Slice(g.scanner.excludeCmds, func(i, j int) bool {
+		return g.scanner.excludeCmds[i].Dir < g.scanner.excludeCmds[j].Dir
+	})
+
+	// Collect hooks, sorted by directory for deterministic order
+	hooks, err := collectHooks(configs)
+	if err != nil {
+		return nil, err
+	}
+
 	// Scan all source directories
 	var allEntries []types.FileEntry
+	var statSkip int
+	g.scanner.denied = nil
 	for _, srcPath := range resolvedPaths {
 		if g.verbose {
 			fmt.Printf("[INFO] Processing: %s\n", srcPath)
 		}
 
+		// Flat layout: the source root itself maps to $HOME
+		if g.opts.Flat || (configs[srcPath] != nil && configs[srcPath].Layout == LayoutFlat) {
+			if g.opts.Base == BaseRoot {
+				continue
+			}
+			flatEntries, flatSkipped, err := g.scanner.ScanDir(srcPath, "flat", linkFolders, excludes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan %s: %w", srcPath, err)
+			}
+			allEntries = append(allEntries, flatEntries...)
+			statSkip += flatSkipped
+			continue
+		}
+
 		// Scan home directory
-		homeEntries, err := g.scanner.ScanDir(srcPath, "home", linkFolders)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan home directory in %s: %w", srcPath, err)
+		if g.opts.Base != BaseRoot {
+			homeEntries, homeSkipped, err := g.scanner.ScanDir(srcPath, "home", linkFolders, excludes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan home directory in %s: %w", srcPath, err)
+			}
+			allEntries = append(allEntries, homeEntries...)
+			statSkip += homeSkipped
 		}
-		allEntries = append(allEntries, homeEntries...)
 
 		// Scan root directory
-		rootEntries, err := g.scanner.ScanDir(srcPath, "root", linkFolders)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan root directory in %s: %w", srcPath, err)
+		if g.opts.Base != BaseHome {
+			rootEntries, rootSkipped, err := g.scanner.ScanDir(srcPath, "root", linkFolders, excludes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan root directory in %s: %w", srcPath, err)
+			}
+			allEntries = append(allEntries, rootEntries...)
+			statSkip += rootSkipped
 		}
-		allEntries = append(allEntries, rootEntries...)
+	}
+	if err := g.reportDenied(); err != nil {
+		return nil, err
 	}
 
-	// Remove duplicates and mark overrides (later sources override earlier ones)
+	// Remove duplicates and mark overrides (later sources override earlier ones).
+	// On case-insensitive filesystems targets differing only in case collide.
 	targetMap := make(map[string]types.FileEntry)
 	for _, entry := range allEntries {
-		if existing, ok := targetMap[entry.Target]; ok {
+		key := fs.PathKey(entry.Target)
+		if existing, ok := targetMap[key]; ok {
+			if existing.Target != entry.Target {
+				fmt.Fprintf(os.Stderr, "[WARN] Case collision on case-insensitive filesystem: %s and %s (%s wins)\n",
+					existing.Source, entry.Source, entry.Source)
+			}
+			if g.explain.concerns(entry.Target) {
+				g.explain.add("OVERRIDE", "layer %s overrides layer %s", filepath.Base(entry.SourcePath), filepath.Base(existing.SourcePath))
+			}
 			// Override - update reason
 			existing.Reason = fmt.Sprintf("override from %s", filepath.Base(entry.SourcePath))
 			existing.Source = entry.Source
 			existing.SourcePath = entry.SourcePath
-			targetMap[entry.Target] = existing
+			existing.EmptyDir = entry.EmptyDir
+			targetMap[key] = existing
 			if g.verbose {
 				fmt.Printf("[OVERRIDE] %s\n", entry.Target)
 			}
 		} else {
-			targetMap[entry.Target] = entry
+			targetMap[key] = entry
 			if g.verbose {
 				fmt.Printf("[NEW] %s\n", entry.Target)
 			}
@@ -265,16 +765,102 @@ func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 		entries = append(entries, entry)
 	}
 
-	// Apply path mappings
-	entries = g.applyPathMappings(configs, entries)
-
-	// Collect external path mappings (links to files/dirs outside cdm management)
-	externalEntries := g.collectExternalPathMappings(configs)
-	entries = append(entries, externalEntries...)
+	// Apply path mappings and collect external path mappings (links to
+	// files/dirs outside cdm management), unless disabled for debugging
+	if g.opts.NoRemap {
+		if g.explain != nil {
+			g.explain.add("NOREMAP", "pathMappings and --target-map are not applied (--no-remap)")
+		}
+		if g.verbose {
+			fmt.Printf("[INFO] --no-remap: pathMappings and --target-map are not applied\n")
+		}
+	} else {
+		entries = g.applyPathMappings(configs, entries)
+		externalEntries := g.collectExternalPathMappings(configs)
+		entries = append(entries, externalEntries...)
+
+		// One-off overrides of single targets from the command line
+		if g.opts.TargetMap != "" {
+			if entries, err = g.applyTargetMap(entries); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	// Collect file mappings (copy instead of symlink)
-	fileEntries := g.collectFileMappings(configs)
+	fileEntries, fileSkipped := g.collectFileMappings(configs)
 	entries = append(entries, fileEntries...)
+	statSkip += fileSkipped
+
+	// Drop entries whose computed target is excluded
+	targetExcludes, err := collectTargetPatterns(configs, "targetExclude", func(c *types.Config) []string { return c.TargetExclude })
+	if err != nil {
+		return nil, err
+	}
+	if len(targetExcludes) > 0 {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if pattern, ok := matchTarget(targetExcludes, entry.Target); ok {
+				statSkip++
+				if g.explain.concerns(entry.Target) {
+					g.explain.add("EXCLUDE", "%s matches targetExclude %s", entry.Source, pattern)
+				}
+				if g.verbose {
+					fmt.Printf("[EXCLUDE] %s (targetExclude %s)\n", entry.Target, pattern)
+				}
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		entries = kept
+	}
+
+	// Mappings can place targets in either base; keep only the selected one
+	if g.opts.Base != "" {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if InBase(entry.Target, g.opts.Base) {
+				kept = append(kept, entry)
+			}
+		}
+		entries = kept
+	}
+
+	// Drop startup files of shells other than the login shell
+	if shell := loginShell(); shell != "" {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if other, ok := otherShellRC(entry, shell); ok && shellSpecific(configs, entry) {
+				statSkip++
+				if g.explain.concerns(entry.Target) {
+					g.explain.add("SKIP", "%s is a %s startup file and the login shell is %s (shellSpecific)", entry.Source, other, shell)
+				}
+				if g.verbose {
+					fmt.Printf("[SKIP] %s: %s startup file, login shell is %s\n", entry.Target, other, shell)
+				}
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		entries = kept
+	}
+
+	// Resolve targets against the alternate root
+	if g.opts.Root != "" {
+		home, _ := os.UserHomeDir()
+		for i := range entries {
+			entries[i].Target = g.rebaseTarget(entries[i].Target, home)
+		}
+	}
+
+	noBackup, err := collectTargetPatterns(configs, "noBackup", func(c *types.Config) []string { return c.NoBackup })
+	if err != nil {
+		return nil, err
+	}
+	alwaysBackup, err := collectTargetPatterns(configs, "alwaysBackup", func(c *types.Config) []string { return c.AlwaysBackup })
+	if err != nil {
+		return nil, err
+	}
 
 	// Build links
 	var statNew, statOverride int
@@ -287,18 +873,44 @@ func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 		}
 
 		action := "link"
-		if entry.Reason == "file mapping" {
+		if entry.EmptyDir {
+			action = "mkdir"
+		} else if entry.Reason == "file mapping" {
 			action = "copy"
+		} else if g.opts.Hardlink {
+			// Directories (folder links) cannot be hard linked
+			if info, err := os.Stat(entry.Source); err == nil && !info.IsDir() {
+				action = "hardlink"
+			}
 		}
 
 		links = append(links, types.Link{
-			Source: entry.Source,
-			Target: entry.Target,
-			Action: action,
-			Reason: entry.Reason,
+			Source:         entry.Source,
+			Target:         entry.Target,
+			Action:         action,
+			Reason:         entry.Reason,
+			RequireConfirm: requiresConfirm(configs, entry),
+			Owner:          expectedOwner(configs, entry),
+			Mode:           expectedMode(configs, entry),
+			DirMode:        expectedDirMode(configs, entry),
+			Xattrs:         expectedXattrs(configs, entry),
+			Backup:         backupPolicy(noBackup, alwaysBackup, entry.Target),
 		})
 	}
 
+	for _, link := range links {
+		if link.Mode != "" {
+			if _, err := fs.ParseMode(link.Mode); err != nil {
+				return nil, fmt.Errorf("invalid permissions for %s: %w", link.Source, err)
+			}
+		}
+		if link.DirMode != "" {
+			if _, err := fs.ParseMode(link.DirMode); err != nil {
+				return nil, fmt.Errorf("invalid dirPermissions for %s: %w", link.Source, err)
+			}
+		}
+	}
+
 	// Get hostname
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -307,23 +919,329 @@ func (g *Generator) Generate(sourcePaths []string) (*types.Plan, error) {
 
 	// Build plan
 	plan := &types.Plan{
-		Version:   "1.0.0",
-		Timestamp: time.Now(),
-		Hostname:  hostname,
-		Sources:   resolvedPaths,
-		Links:     links,
-		Repos:     allRepos,
+		Version:      types.PlanVersion,
+		Timestamp:    time.Now(),
+		Hostname:     hostname,
+		Root:         g.opts.Root,
+		Sources:      resolvedPaths,
+		Links:        links,
+		Repos:        allRepos,
+		Hooks:        hooks,
+		Requirements: collectRequirements(hooks, links),
 		Stats: types.Stats{
 			Total:    len(links),
 			New:      statNew,
 			Override: statOverride,
-			Skip:     0,
+			Skip:     statSkip,
 		},
 	}
 
 	return plan, nil
 }
 
+// TargetPattern is a compiled glob matched against target paths
+// (targetExclude, noBackup, alwaysBackup)
+type TargetPattern struct {
+	Pattern string // Pattern as written in the config
+	re      *regexp.Regexp
+}
+
+// collectTargetPatterns compiles the target patterns picked from every
+// config, expanding a leading ~ to the home directory
+func collectTargetPatterns(configs map[string]*types.Config, field string, pick func(*types.Config) []string) ([]TargetPattern, error) {
+	var rules []TargetPattern
+	for configPath, cfg := range configs {
+		for _, pattern := range pick(cfg) {
+			expanded, err := fs.ExpandPath(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to expand %s %s: %w", field, pattern, err)
+			}
+			re, err := ignore.GlobRegexp(filepath.ToSlash(filepath.Clean(expanded)))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in %s: %w", field, configPath, err)
+			}
+			rules = append(rules, TargetPattern{Pattern: pattern, re: re})
+		}
+	}
+	return rules, nil
+}
+
+// CompileTargetPatterns compiles target globs that are already expanded to
+// absolute paths, such as the when globs of a plan's hooks
+func CompileTargetPatterns(patterns []string) ([]TargetPattern, error) {
+	rules := make([]TargetPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := ignore.GlobRegexp(filepath.ToSlash(filepath.Clean(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, TargetPattern{Pattern: pattern, re: re})
+	}
+	return rules, nil
+}
+
+// MatchTarget reports whether a target, or any directory containing it,
+// matches one of the target patterns
+func MatchTarget(rules []TargetPattern, target string) bool {
+	_, ok := matchTarget(rules, target)
+	return ok
+}
+
+// matchTarget checks if a target, or any directory containing it, matches
+// a target pattern. Returns the matching pattern.
+func matchTarget(rules []TargetPattern, target string) (string, bool) {
+	for path := filepath.Clean(target); ; {
+		for _, rule := range rules {
+			if rule.re.MatchString(filepath.ToSlash(path)) {
+				return rule.Pattern, true
+			}
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", false
+		}
+		path = parent
+	}
+}
+
+// backupPolicy returns the link backup override for a target: "always"
+// if it matches alwaysBackup (which wins), "never" if it matches noBackup
+func backupPolicy(noBackup, alwaysBackup []TargetPattern, target string) string {
+	if _, ok := matchTarget(alwaysBackup, target); ok {
+		return types.BackupAlways
+	}
+	if _, ok := matchTarget(noBackup, target); ok {
+		return types.BackupNever
+	}
+	return ""
+}
+
+// collectHooks gathers the hooks of every config, ordered by config
+// directory. The when globs are expanded to absolute paths and validated.
+func collectHooks(configs map[string]*types.Config) ([]types.HookSet, error) {
+	var hooks []types.HookSet
+	for configPath, cfg := range configs {
+		if cfg.Hooks == nil || (cfg.Hooks.PreApply == "" && cfg.Hooks.PostApply == "") {
+			continue
+		}
+		var when []string
+		for _, pattern := range cfg.Hooks.When {
+			expanded, err := fs.ExpandPath(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to expand hooks.when %s: %w", pattern, err)
+			}
+			when = append(when, filepath.Clean(expanded))
+		}
+		if _, err := CompileTargetPatterns(when); err != nil {
+			return nil, fmt.Errorf("invalid hooks.when in %s: %w", configPath, err)
+		}
+		hooks = append(hooks, types.HookSet{
+			Dir:       configPath,
+			PreApply:  cfg.Hooks.PreApply,
+			PostApply: cfg.Hooks.PostApply,
+			When:      when,
+		})
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Dir < hooks[j].Dir
+	})
+	return hooks, nil
+}
+
+// activeRules returns a copy of cfg without the path mappings, file
+// mappings, excludes and linkFolders whose when predicate is false
+func (g *Generator) activeRules(configPath string, cfg *types.Config) *types.Config {
+	active := *cfg
+
+	active.PathMappings = nil
+	for _, m := range cfg.PathMappings {
+		if g.whenHolds(configPath, "pathMapping "+m.Source, m.When) {
+			active.PathMappings = append(active.PathMappings, m)
+		}
+	}
+	active.FileMappings = nil
+	for _, m := range cfg.FileMappings {
+		if g.whenHolds(configPath, "fileMapping "+m.Source, m.When) {
+			active.FileMappings = append(active.FileMappings, m)
+		}
+	}
+	active.Exclude = nil
+	for _, c := range cfg.Exclude {
+		if g.whenHolds(configPath, "exclude "+c.Value, c.When) {
+			active.Exclude = append(active.Exclude, c)
+		}
+	}
+	active.LinkFolders = nil
+	for _, c := range cfg.LinkFolders {
+		if g.whenHolds(configPath, "linkFolders "+c.Value, c.When) {
+			active.LinkFolders = append(active.LinkFolders, c)
+		}
+	}
+	active.MergeFolders = nil
+	for _, c := range cfg.MergeFolders {
+		if g.whenHolds(configPath, "mergeFolders "+c.Value, c.When) {
+			active.MergeFolders = append(active.MergeFolders, c)
+		}
+	}
+
+	return &active
+}
+
+// layerRelPath returns the path of a source file or directory relative to
+// the layout of its layer ("home/.config/nvim"), so the same directory can
+// be recognized across layers. Flat layers count as the home base.
+func (g *Generator) layerRelPath(sourceRoots []string, configs map[string]*types.Config, path string) (string, bool) {
+	root := ""
+	for _, candidate := range sourceRoots {
+		if (path == candidate || strings.HasPrefix(path, candidate+string(filepath.Separator))) && len(candidate) > len(root) {
+			root = candidate
+		}
+	}
+	if root == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Join(root, g.opts.StripPrefix), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if g.opts.Flat || (configs[root] != nil && configs[root].Layout == LayoutFlat) {
+		rel = filepath.Join("home", rel)
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// whenHolds evaluates a rule's when predicate against the environment.
+// A nil predicate always holds.
+func (g *Generator) whenHolds(configPath, rule string, when *types.When) bool {
+	if when == nil {
+		return true
+	}
+	for name, want := range when.Env {
+		if got, ok := os.LookupEnv(name); !ok || got != want {
+			if g.verbose {
+				fmt.Printf("[WHEN] Skipping %s in %s: %s != %q\n", rule, configPath, name, want)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// requiresConfirm reports whether an entry comes from a config directory
+// that has requireConfirm set
+func requiresConfirm(configs map[string]*types.Config, entry types.FileEntry) bool {
+	for configPath, cfg := range configs {
+		if !cfg.RequireConfirm {
+			continue
+		}
+		if entry.SourcePath == configPath ||
+			entry.Source == configPath ||
+			strings.HasPrefix(entry.Source, configPath+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedOwner returns the configured owner for an entry's target, if any
+func expectedOwner(configs map[string]*types.Config, entry types.FileEntry) string {
+	return configValueFor(configs, entry, func(cfg *types.Config) map[string]string { return cfg.Ownership })
+}
+
+// expectedMode returns the configured permissions for an entry's target, if any
+func expectedMode(configs map[string]*types.Config, entry types.FileEntry) string {
+	return configValueFor(configs, entry, func(cfg *types.Config) map[string]string { return cfg.Permissions })
+}
+
+// expectedXattrs returns the configured extended attributes for an
+// entry's target, if any
+func expectedXattrs(configs map[string]*types.Config, entry types.FileEntry) map[string]string {
+	return configValueFor(configs, entry, func(cfg *types.Config) map[string]map[string]string { return cfg.Xattrs })
+}
+
+// expectedDirMode returns the configured mode for parent directories created
+// for an entry's target. Keys name a subtree: they match the source path or
+// any of its parent directories, relative to the config directory.
+func expectedDirMode(configs map[string]*types.Config, entry types.FileEntry) string {
+	mode := ""
+	modeDepth, patternLen := -1, -1
+	for configPath, cfg := range configs {
+		if len(cfg.DirPermissions) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(configPath, entry.Source)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		for pattern, m := range cfg.DirPermissions {
+			for sub := rel; sub != "." && sub != string(filepath.Separator); sub = filepath.Dir(sub) {
+				if ok, _ := filepath.Match(pattern, sub); !ok {
+					continue
+				}
+				// Deeper configs win, then longer (more specific) patterns
+				depth := len(configPath)
+				if depth > modeDepth || (depth == modeDepth && len(pattern) > patternLen) {
+					mode = m
+					modeDepth, patternLen = depth, len(pattern)
+				}
+				break
+			}
+		}
+	}
+	return mode
+}
+
+// configValueFor looks up a per-path config setting for an entry's target.
+// Keys are globs matched against the target path relative to its base
+// ($HOME or /), e.g. ".ssh/config"; a key matching a directory covers its
+// subtree. Only configs whose directory contains the entry's source apply.
+// The deepest config wins, then the match closest to the target, then the
+// longest pattern, then the first in sorted order, so the result does not
+// depend on map order.
+func configValueFor[T any](configs map[string]*types.Config, entry types.FileEntry, pick func(*types.Config) map[string]T) T {
+	rel := targetBaseRel(entry.Target)
+	var value T
+	valueDepth, subLen, valuePattern := -1, -1, ""
+	for configPath, cfg := range configs {
+		values := pick(cfg)
+		if len(values) == 0 {
+			continue
+		}
+		if r, err := filepath.Rel(configPath, entry.Source); err != nil || strings.HasPrefix(r, "..") {
+			continue
+		}
+		depth := len(configPath)
+		for pattern, v := range values {
+			for sub := rel; sub != "." && sub != string(filepath.Separator); sub = filepath.Dir(sub) {
+				if ok, _ := filepath.Match(pattern, sub); !ok {
+					continue
+				}
+				if depth > valueDepth ||
+					(depth == valueDepth && len(sub) > subLen) ||
+					(depth == valueDepth && len(sub) == subLen && (len(pattern) > len(valuePattern) ||
+						(len(pattern) == len(valuePattern) && pattern < valuePattern))) {
+					value = v
+					valueDepth, subLen, valuePattern = depth, len(sub), pattern
+				}
+				break
+			}
+		}
+	}
+	return value
+}
+
+// targetBaseRel returns a target path relative to its base: $HOME for
+// targets inside it, / for everything else
+func targetBaseRel(target string) string {
+	if fs.InHome(target) {
+		home, _ := os.UserHomeDir()
+		if rel, err := filepath.Rel(home, target); err == nil {
+			return rel
+		}
+	}
+	return strings.TrimPrefix(target, string(filepath.Separator))
+}
+
 // applyPathMappings applies path mappings from configuration files
 func (g *Generator) applyPathMappings(configs map[string]*types.Config, entries []types.FileEntry) []types.FileEntry {
 	home, _ := os.UserHomeDir()
@@ -363,24 +1281,46 @@ func (g *Generator) applyPathMappings(configs map[string]*types.Config, entries
 					sourceRelPath = sourceExpanded
 				}
 
-				// Check if relPath starts with mapping source
-				if strings.HasPrefix(relPath, sourceRelPath) {
-					// Calculate new target
-					newTarget := mapping.Target + strings.TrimPrefix(relPath, sourceRelPath)
-
-					// Expand ~ in target
-					expanded, err := fs.ExpandPath(newTarget)
-					if err != nil {
+				// Calculate new target: wildcard sources substitute captures
+				// into the target, plain sources rewrite the matching path
+				// (a file source renames just that file)
+				var newTarget string
+				if re, ok := templatedSourcePattern(mapping.Source, sourceRelPath); ok {
+					captures := re.FindStringSubmatch(relPath)
+					if captures == nil {
 						continue
 					}
+					newTarget = expandCaptures(mapping.Target, captures)
+				} else if rest, ok := underPath(relPath, sourceRelPath); ok {
+					newTarget = mapping.Target + rest
+				} else {
+					continue
+				}
 
-					result[i].Target = expanded
-					result[i].Reason = fmt.Sprintf("%s (remapped by %s)", entry.Reason, filepath.Base(srcPath))
+				// Expand ~ in target
+				expanded, err := fs.ExpandPath(newTarget)
+				if err != nil {
+					continue
+				}
 
-					if g.verbose {
-						fmt.Printf("[REMAP] %s -> %s\n", entry.Target, expanded)
+				// Relative targets are relative to the entry's base
+				if !filepath.IsAbs(expanded) {
+					if home != "" && strings.HasPrefix(entry.Target, home+string(filepath.Separator)) {
+						expanded = filepath.Join(home, expanded)
+					} else {
+						expanded = filepath.Join("/", expanded)
 					}
 				}
+
+				if g.explain.concerns(entry.Target) || g.explain.concerns(expanded) {
+					g.explain.add("REMAP", "pathMappings in %s: %s -> %s (%s)", srcPath, entry.Target, expanded, entry.Source)
+				}
+				result[i].Target = expanded
+				result[i].Reason = fmt.Sprintf("%s (remapped by %s)", entry.Reason, filepath.Base(srcPath))
+
+				if g.verbose {
+					fmt.Printf("[REMAP] %s -> %s\n", entry.Target, expanded)
+				}
 			}
 		}
 	}
@@ -388,6 +1328,89 @@ func (g *Generator) applyPathMappings(configs map[string]*types.Config, entries
 	return result
 }
 
+// RegexSourcePrefix marks a path mapping source as a regular expression
+const RegexSourcePrefix = "re:"
+
+// underPath reports whether rel is the path prefix or lies below it, and
+// returns the rest of rel after prefix: "" when rel is prefix itself (a
+// renamed file), "/sub/path" for entries below it
+func underPath(rel, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return rel, true
+	}
+	if rel == prefix {
+		return "", true
+	}
+	if strings.HasPrefix(rel, prefix+"/") {
+		return strings.TrimPrefix(rel, prefix), true
+	}
+	return "", false
+}
+
+// templatedSourcePattern compiles a path mapping source into an anchored
+// regexp if it is a regex ("re:" prefix) or contains glob wildcards.
+// Each glob wildcard becomes a capture group: "*" and "?" match within a
+// single path component, "**" matches across components.
+func templatedSourcePattern(source, sourceRelPath string) (*regexp.Regexp, bool) {
+	if strings.HasPrefix(source, RegexSourcePrefix) {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(source, RegexSourcePrefix) + ")$")
+		if err != nil {
+			return nil, false
+		}
+		return re, true
+	}
+
+	if !strings.ContainsAny(sourceRelPath, "*?[") {
+		return nil, false
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(sourceRelPath); i++ {
+		c := sourceRelPath[i]
+		switch {
+		case c == '*' && i+1 < len(sourceRelPath) && sourceRelPath[i+1] == '*':
+			sb.WriteString("(.*)")
+			i++
+		case c == '*':
+			sb.WriteString("([^/]*)")
+		case c == '?':
+			sb.WriteString("([^/])")
+		case c == '[':
+			end := strings.IndexByte(sourceRelPath[i:], ']')
+			if end < 0 {
+				return nil, false
+			}
+			sb.WriteString("(" + sourceRelPath[i:i+end+1] + ")")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, false
+	}
+	return re, true
+}
+
+// captureRef matches $1, $2, ... references in a mapping target
+var captureRef = regexp.MustCompile(`\$(\d+)`)
+
+// expandCaptures substitutes $N references in target with captured groups
+func expandCaptures(target string, captures []string) string {
+	return captureRef.ReplaceAllStringFunc(target, func(ref string) string {
+		n, _ := strconv.Atoi(ref[1:])
+		if n < len(captures) {
+			return captures[n]
+		}
+		return ref
+	})
+}
+
 // collectExternalPathMappings collects path mappings for files/dirs outside cdm management
 func (g *Generator) collectExternalPathMappings(configs map[string]*types.Config) []types.FileEntry {
 	var entries []types.FileEntry
@@ -425,6 +1448,9 @@ func (g *Generator) collectExternalPathMappings(configs map[string]*types.Config
 			}
 
 			entries = append(entries, entry)
+			if g.explain.concerns(targetExpanded) {
+				g.explain.add("EXTERNAL", "pathMappings in %s links %s", srcPath, sourceExpanded)
+			}
 
 			if g.verbose {
 				fmt.Printf("[EXTERNAL_MAPPING] %s -> %s\n", targetExpanded, sourceExpanded)
@@ -436,8 +1462,10 @@ func (g *Generator) collectExternalPathMappings(configs map[string]*types.Config
 }
 
 // collectFileMappings collects file mappings (copy instead of symlink)
-func (g *Generator) collectFileMappings(configs map[string]*types.Config) []types.FileEntry {
+// Returns the entries and the number of mappings skipped for missing sources.
+func (g *Generator) collectFileMappings(configs map[string]*types.Config) ([]types.FileEntry, int) {
 	var entries []types.FileEntry
+	var skipped int
 
 	for srcPath, cfg := range configs {
 		if len(cfg.FileMappings) == 0 {
@@ -460,6 +1488,7 @@ func (g *Generator) collectFileMappings(configs map[string]*types.Config) []type
 				if g.verbose {
 					fmt.Printf("[SKIP] File mapping source not found: %s\n", sourceExpanded)
 				}
+				skipped++
 				continue
 			}
 
@@ -477,6 +1506,9 @@ func (g *Generator) collectFileMappings(configs map[string]*types.Config) []type
 			}
 
 			entries = append(entries, entry)
+			if g.explain.concerns(targetExpanded) {
+				g.explain.add("COPY", "fileMappings in %s copies %s", srcPath, sourceExpanded)
+			}
 
 			if g.verbose {
 				fmt.Printf("[FILE_MAPPING] %s -> %s\n", sourceExpanded, targetExpanded)
@@ -484,5 +1516,47 @@ func (g *Generator) collectFileMappings(configs map[string]*types.Config) []type
 		}
 	}
 
-	return entries
-}
\ No newline at end of file
+	return entries, skipped
+}
+
+// CheckSources verifies that every link's source exists and is readable.
+// Returns one problem description per failing link.
+func CheckSources(plan *types.Plan) []string {
+	var problems []string
+
+	for _, link := range plan.Links {
+		info, err := os.Stat(link.Source)
+		if err != nil {
+			if os.IsNotExist(err) {
+				problems = append(problems, fmt.Sprintf("%s: source does not exist", link.Source))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: %v", link.Source, err))
+			}
+			continue
+		}
+
+		if info.IsDir() {
+			f, err := os.Open(link.Source)
+			if err == nil {
+				_, err = f.Readdirnames(1)
+				f.Close()
+				if err == io.EOF {
+					err = nil
+				}
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: directory not readable: %v", link.Source, err))
+			}
+			continue
+		}
+
+		f, err := os.Open(link.Source)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: not readable: %v", link.Source, err))
+			continue
+		}
+		f.Close()
+	}
+
+	return problems
+}
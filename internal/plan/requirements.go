@@ -0,0 +1,70 @@
+package plan
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// shellBuiltins are commands a hook may start with that are not executables
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "cd": true, "eval": true, "exec": true, "exit": true,
+	"export": true, "set": true, "source": true, "test": true, "[": true,
+	"true": true, "false": true, "unset": true, "umask": true,
+}
+
+// HookCommand returns the executable a hook command starts with, or "" for
+// empty commands and shell builtins. Relative paths are resolved against
+// the hook directory.
+func HookCommand(dir, command string) string {
+	fields := strings.Fields(command)
+	// Skip leading VAR=value assignments
+	for len(fields) > 0 && strings.Contains(fields[0], "=") && !strings.HasPrefix(fields[0], "=") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+
+	name := strings.Trim(fields[0], `"'`)
+	if shellBuiltins[name] {
+		return ""
+	}
+	if strings.Contains(name, "/") && !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	return name
+}
+
+// collectRequirements lists the commands the plan's hooks run and whether
+// any target is in a system directory that needs privileges
+func collectRequirements(hooks []types.HookSet, links []types.Link) *types.Requirements {
+	req := &types.Requirements{}
+
+	seen := make(map[string]bool)
+	for _, hook := range hooks {
+		for _, command := range []string{hook.PreApply, hook.PostApply} {
+			name := HookCommand(hook.Dir, command)
+			if name != "" && !seen[name] {
+				seen[name] = true
+				req.Commands = append(req.Commands, name)
+			}
+		}
+	}
+	sort.Strings(req.Commands)
+
+	for _, link := range links {
+		if fs.NeedsSudo(link.Target) {
+			req.Sudo = true
+			break
+		}
+	}
+
+	if len(req.Commands) == 0 && !req.Sudo {
+		return nil
+	}
+	return req
+}
@@ -0,0 +1,66 @@
+package plan
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// shellRCFiles maps shell startup file names to the shell that reads them
+var shellRCFiles = map[string]string{
+	".bashrc":       "bash",
+	".bash_profile": "bash",
+	".bash_login":   "bash",
+	".bash_logout":  "bash",
+	".bash_aliases": "bash",
+	".zshrc":        "zsh",
+	".zshenv":       "zsh",
+	".zprofile":     "zsh",
+	".zlogin":       "zsh",
+	".zlogout":      "zsh",
+	".kshrc":        "ksh",
+	".cshrc":        "csh",
+	".tcshrc":       "tcsh",
+	"config.fish":   "fish",
+}
+
+// loginShell returns the name of the user's shell from $SHELL, e.g. "zsh"
+func loginShell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		return ""
+	}
+	return filepath.Base(shell)
+}
+
+// shellSpecific reports whether an entry's source is covered by a config
+// with shellSpecific set
+func shellSpecific(configs map[string]*types.Config, entry types.FileEntry) bool {
+	for configPath, cfg := range configs {
+		if !cfg.ShellSpecific {
+			continue
+		}
+		if entry.SourcePath == configPath ||
+			entry.Source == configPath ||
+			strings.HasPrefix(entry.Source, configPath+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// otherShellRC returns the shell an entry's target is a startup file for,
+// if that is not the given shell
+func otherShellRC(entry types.FileEntry, shell string) (string, bool) {
+	owner, ok := shellRCFiles[filepath.Base(entry.Target)]
+	if !ok || owner == shell {
+		return "", false
+	}
+	// csh startup files are shared with tcsh
+	if owner == "csh" && shell == "tcsh" {
+		return "", false
+	}
+	return owner, true
+}
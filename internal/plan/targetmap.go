@@ -0,0 +1,92 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/woodgear/cdm/internal/fs"
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// loadTargetMap reads a --target-map file: a JSON object mapping source
+// files, relative to their source root or absolute, to target paths
+func loadTargetMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target map %s: %w", path, err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse target map %s: %w", path, err)
+	}
+	targetMap := make(map[string]string, len(raw))
+	for source, target := range raw {
+		targetMap[filepath.ToSlash(filepath.Clean(source))] = target
+	}
+	return targetMap, nil
+}
+
+// applyTargetMap overrides the targets of individual source files from the
+// --target-map file. Relative targets are relative to the entry's base
+// (home or /). Map entries matching no planned file are reported.
+func (g *Generator) applyTargetMap(entries []types.FileEntry) ([]types.FileEntry, error) {
+	targetMap, err := loadTargetMap(g.opts.TargetMap)
+	if err != nil {
+		return nil, err
+	}
+	home, _ := os.UserHomeDir()
+
+	used := make(map[string]bool, len(targetMap))
+	for i, entry := range entries {
+		key := entry.Source
+		target, ok := targetMap[key]
+		if !ok {
+			rel, err := filepath.Rel(entry.SourcePath, entry.Source)
+			if err != nil {
+				continue
+			}
+			key = filepath.ToSlash(rel)
+			if target, ok = targetMap[key]; !ok {
+				continue
+			}
+		}
+		used[key] = true
+
+		expanded, err := fs.ExpandPath(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q for %s in target map: %w", target, key, err)
+		}
+		if !filepath.IsAbs(expanded) {
+			if home != "" && strings.HasPrefix(entry.Target, home+string(filepath.Separator)) {
+				expanded = filepath.Join(home, expanded)
+			} else {
+				expanded = filepath.Join("/", expanded)
+			}
+		}
+
+		if g.explain.concerns(entry.Target) || g.explain.concerns(expanded) {
+			g.explain.add("TARGETMAP", "--target-map: %s -> %s (%s)", entry.Target, expanded, entry.Source)
+		}
+		if g.verbose {
+			fmt.Printf("[TARGET_MAP] %s -> %s\n", entry.Target, expanded)
+		}
+		entries[i].Target = expanded
+		entries[i].Reason = fmt.Sprintf("%s (target map)", entry.Reason)
+	}
+
+	var unused []string
+	for key := range targetMap {
+		if !used[key] {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	for _, key := range unused {
+		fmt.Fprintf(os.Stderr, "[WARN] Target map entry matches no planned file: %s\n", key)
+	}
+	return entries, nil
+}
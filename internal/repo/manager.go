@@ -52,6 +52,69 @@ func GetCurrentBranch(path string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+// ChangedFiles lists the files under dir that differ from ref (committed or
+// not), as absolute paths. dir must be inside a git repository.
+func ChangedFiles(dir, ref string) ([]string, error) {
+	cmd := exec.Command("git", "-C", dir, "diff", "--name-only", "-z", "--relative", ref, "--", ".")
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s against %s: %w", dir, ref, err)
+	}
+
+	var files []string
+	for _, rel := range strings.Split(string(output), "\x00") {
+		if rel != "" {
+			files = append(files, filepath.Join(dir, rel))
+		}
+	}
+	return files, nil
+}
+
+// InWorkTree checks if dir is inside a git working tree
+func InWorkTree(dir string) bool {
+	cmd := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree")
+	output, err := cmd.Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+// DirtyFiles lists uncommitted changes (including untracked files) under
+// dir as "git status --porcelain" lines, with paths relative to the
+// repository root
+func DirtyFiles(dir string) ([]string, error) {
+	cmd := exec.Command("git", "-C", dir, "status", "--porcelain", "--", ".")
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of %s: %w", dir, err)
+	}
+
+	var files []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// Commit stages and commits the given paths in the repository containing dir
+func Commit(dir, message string, paths []string) error {
+	add := exec.Command("git", append([]string{"-C", dir, "add", "--"}, paths...)...)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		return fmt.Errorf("failed to stage files in %s: %w", dir, err)
+	}
+
+	commit := exec.Command("git", append([]string{"-C", dir, "commit", "-m", message, "--"}, paths...)...)
+	commit.Stdout = os.Stdout
+	commit.Stderr = os.Stderr
+	if err := commit.Run(); err != nil {
+		return fmt.Errorf("failed to commit in %s: %w", dir, err)
+	}
+	return nil
+}
+
 // Clone clones a repository
 func (m *Manager) Clone(url, path string) error {
 	if m.verbose {
@@ -0,0 +1,154 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/woodgear/cdm/internal/config"
+)
+
+// GitSourcePrefix marks a source path argument as a remote git repository
+const GitSourcePrefix = "git+"
+
+// IsGitSource checks if a source spec refers to a remote git repository
+func IsGitSource(spec string) bool {
+	return strings.HasPrefix(spec, GitSourcePrefix)
+}
+
+// ParseGitSource splits a git+ source spec into clone URL and optional ref.
+// e.g. git+https://github.com/me/dotfiles#v1 -> (https://github.com/me/dotfiles, v1)
+func ParseGitSource(spec string) (url, ref string) {
+	url = strings.TrimPrefix(spec, GitSourcePrefix)
+	if idx := strings.LastIndex(url, "#"); idx >= 0 {
+		ref = url[idx+1:]
+		url = url[:idx]
+	}
+	return url, ref
+}
+
+// SourceCacheDir returns the cache directory used for a remote source URL
+func SourceCacheDir(url string) (string, error) {
+	cacheDir, err := config.CacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])[:16]), nil
+}
+
+// ResolveSources replaces git+ source specs with local cache paths,
+// cloning or updating the cached repositories as needed.
+// Other paths are returned unchanged.
+func (m *Manager) ResolveSources(specs []string) ([]string, error) {
+	resolved := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		if !IsGitSource(spec) {
+			resolved = append(resolved, spec)
+			continue
+		}
+
+		path, err := m.ResolveGitSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, path)
+	}
+	return resolved, nil
+}
+
+// ResolveGitSource clones or updates a git+ source into the cache and
+// returns the local path. If the remote is unreachable, the ref is checked
+// out from the objects already in the cache.
+func (m *Manager) ResolveGitSource(spec string) (string, error) {
+	url, ref := ParseGitSource(spec)
+	if url == "" {
+		return "", fmt.Errorf("invalid git source: %s", spec)
+	}
+
+	cacheDir, err := SourceCacheDir(url)
+	if err != nil {
+		return "", err
+	}
+
+	if !IsGitRepo(cacheDir) {
+		if err := os.MkdirAll(filepath.Dir(cacheDir), 0755); err != nil {
+			return "", fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		if err := m.Clone(url, cacheDir); err != nil {
+			return "", fmt.Errorf("failed to clone %s: %w", url, err)
+		}
+	} else {
+		if m.verbose {
+			fmt.Printf("[FETCH] %s (%s)\n", url, cacheDir)
+		}
+		if err := exec.Command("git", "-C", cacheDir, "fetch", "--tags", "origin").Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] Failed to fetch %s, using cached copy\n", url)
+		}
+	}
+
+	path := cacheDir
+	if ref == "" {
+		// Follow the remote default branch
+		ref = "origin/HEAD"
+	} else {
+		// Each pinned ref gets its own working tree so that specs of the
+		// same repository with different refs do not share one checkout
+		if path, err = m.refWorktree(cacheDir, ref); err != nil {
+			return "", fmt.Errorf("failed to create worktree for %s in %s: %w", ref, url, err)
+		}
+	}
+	if err := m.checkoutRef(path, ref); err != nil {
+		return "", fmt.Errorf("failed to checkout %s in %s: %w", ref, url, err)
+	}
+
+	if m.verbose {
+		fmt.Printf("[SOURCE] %s -> %s\n", spec, path)
+	}
+
+	return path, nil
+}
+
+// refWorktree returns the working tree used for a pinned ref of the
+// repository cached in cacheDir, adding it as a git worktree if needed
+func (m *Manager) refWorktree(cacheDir, ref string) (string, error) {
+	sum := sha256.Sum256([]byte(ref))
+	path := cacheDir + "@" + hex.EncodeToString(sum[:])[:8]
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		return path, nil
+	}
+
+	if m.verbose {
+		fmt.Printf("[WORKTREE] %s: %s\n", path, ref)
+	}
+	// Forget worktrees whose directory was removed from the cache
+	exec.Command("git", "-C", cacheDir, "worktree", "prune").Run()
+	cmd := exec.Command("git", "-C", cacheDir, "worktree", "add", "--quiet", "--detach", path)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkoutRef checks out a pinned ref (branch, tag or commit) with a
+// detached HEAD. Branches are checked out at their remote counterpart, so
+// the working tree always matches the last fetch and never diverges.
+func (m *Manager) checkoutRef(path, ref string) error {
+	rev := ref
+	// Only branches have a remote counterpart to follow
+	if exec.Command("git", "-C", path, "show-ref", "--verify", "--quiet", "refs/remotes/origin/"+ref).Run() == nil {
+		rev = "origin/" + ref
+	}
+
+	if m.verbose {
+		fmt.Printf("[CHECKOUT] %s: %s\n", path, rev)
+	}
+	cmd := exec.Command("git", "-C", path, "checkout", "--quiet", "--detach", rev)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,155 @@
+// Package tree renders a plan as an indented tree of targets
+package tree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/woodgear/cdm/pkg/types"
+)
+
+// node is a single path component in the rendered tree
+type node struct {
+	name     string
+	link     *types.Link
+	children map[string]*node
+}
+
+func newNode(name string) *node {
+	return &node{name: name, children: make(map[string]*node)}
+}
+
+// insert adds a link under this node following the given path components
+func (n *node) insert(parts []string, link types.Link) {
+	cur := n
+	for _, part := range parts {
+		child, ok := cur.children[part]
+		if !ok {
+			child = newNode(part)
+			cur.children[part] = child
+		}
+		cur = child
+	}
+	l := link
+	cur.link = &l
+}
+
+// sortedChildren returns children sorted by name
+func (n *node) sortedChildren() []*node {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*node, 0, len(names))
+	for _, name := range names {
+		result = append(result, n.children[name])
+	}
+	return result
+}
+
+// SourceLayer returns the name of the plan source a link source belongs to.
+// Links whose source lies outside every plan source (e.g. external mappings)
+// return "external".
+func SourceLayer(sources []string, source string) string {
+	layer := ""
+	for _, src := range sources {
+		if source == src || strings.HasPrefix(source, src+string(filepath.Separator)) {
+			// Prefer the most specific source when sources are nested
+			if len(src) >= len(layer) {
+				layer = src
+			}
+		}
+	}
+	if layer == "" {
+		return "external"
+	}
+	return filepath.Base(layer)
+}
+
+// PrintTree prints the plan's links as a tree of targets grouped by base,
+// annotated with their source layer and plan reason
+func PrintTree(plan *types.Plan) {
+	PrintTreeWith(plan, func(link types.Link) string {
+		return fmt.Sprintf("[%s] (%s)", SourceLayer(plan.Sources, link.Source), link.Reason)
+	})
+}
+
+// PrintTreeWith prints the plan's links as a tree of targets grouped by
+// base, annotating each target with label(link)
+func PrintTreeWith(plan *types.Plan, label func(types.Link) string) {
+	home, _ := os.UserHomeDir()
+
+	rootDir := "/"
+	if plan.Root != "" {
+		rootDir = plan.Root
+	}
+
+	homeRoot := newNode("home (" + home + ")")
+	rootRoot := newNode("root (" + rootDir + ")")
+	var homeCount, rootCount int
+
+	for _, link := range plan.Links {
+		if home != "" && strings.HasPrefix(link.Target, home+string(filepath.Separator)) {
+			rel := strings.TrimPrefix(link.Target, home+string(filepath.Separator))
+			homeRoot.insert(strings.Split(rel, string(filepath.Separator)), link)
+			homeCount++
+			continue
+		}
+		rel, err := filepath.Rel(rootDir, link.Target)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = strings.TrimPrefix(link.Target, string(filepath.Separator))
+		}
+		rootRoot.insert(strings.Split(rel, string(filepath.Separator)), link)
+		rootCount++
+	}
+
+	printed := false
+	if homeCount > 0 {
+		printRoot(homeRoot, label)
+		printed = true
+	}
+	if rootCount > 0 {
+		if printed {
+			fmt.Println()
+		}
+		printRoot(rootRoot, label)
+		printed = true
+	}
+	if !printed {
+		fmt.Println("[INFO] Plan has no links")
+	}
+}
+
+// printRoot prints a base node and all of its descendants
+func printRoot(root *node, label func(types.Link) string) {
+	fmt.Println(root.name)
+	printChildren(root, "", label)
+}
+
+// printChildren recursively prints children using box-drawing connectors
+func printChildren(n *node, prefix string, label func(types.Link) string) {
+	children := n.sortedChildren()
+	for i, child := range children {
+		last := i == len(children)-1
+
+		connector := "├── "
+		nextPrefix := prefix + "│   "
+		if last {
+			connector = "└── "
+			nextPrefix = prefix + "    "
+		}
+
+		line := prefix + connector + child.name
+		if child.link != nil {
+			line += "  " + label(*child.link)
+		}
+		fmt.Println(line)
+
+		printChildren(child, nextPrefix, label)
+	}
+}
@@ -0,0 +1,127 @@
+// Package watch watches source trees and reports debounced batches of changes
+package watch
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher watches every directory below a set of source roots
+type Watcher struct {
+	fsw     *fsnotify.Watcher
+	verbose bool
+}
+
+// New creates a watcher over the given roots and all directories below them.
+// Version control directories are not watched. Changed paths are reported
+// as absolute paths.
+func New(roots []string, verbose bool) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+	w := &Watcher{fsw: fsw, verbose: verbose}
+	for _, root := range roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("failed to resolve path %s: %w", root, err)
+		}
+		if err := w.addTree(absRoot); err != nil {
+			fsw.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	return w.fsw.Close()
+}
+
+// addTree watches dir and every directory below it
+func (w *Watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory may vanish between the event and the walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && isVCSDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		if err := w.fsw.Add(path); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func isVCSDir(name string) bool {
+	return name == ".git" || name == ".hg" || name == ".svn"
+}
+
+// Run calls onChange with the paths changed since the last call once no
+// further event arrived for the debounce interval. It returns nil when ctx
+// is done.
+func (w *Watcher) Run(ctx context.Context, debounce time.Duration, onChange func(changed []string)) error {
+	pending := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			// New directories are not covered by the existing watches
+			if event.Op.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() && !isVCSDir(info.Name()) {
+					if err := w.addTree(event.Name); err != nil {
+						fmt.Fprintf(os.Stderr, "[WARN] %s\n", err)
+					}
+				}
+			}
+			if w.verbose {
+				fmt.Printf("[WATCH] %s %s\n", event.Op, event.Name)
+			}
+			pending[event.Name] = true
+			timer.Reset(debounce)
+
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "[WARN] Watcher error: %s\n", err)
+
+		case <-timer.C:
+			changed := make([]string, 0, len(pending))
+			for path := range pending {
+				changed = append(changed, path)
+			}
+			sort.Strings(changed)
+			pending = make(map[string]bool)
+			onChange(changed)
+		}
+	}
+}
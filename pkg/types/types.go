@@ -1,58 +1,157 @@
 // Package types defines the core data structures for CDM
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Config represents the .cdm.conf.json configuration file structure
 type Config struct {
-	Version       string        `json:"version,omitempty"`
-	PathMappings  []PathMapping `json:"pathMappings,omitempty"`
-	FileMappings  []PathMapping `json:"fileMappings,omitempty"` // Files to copy (not symlink) for consistency
-	Exclude       []string      `json:"exclude,omitempty"`
-	LinkFolders   []string      `json:"linkFolders,omitempty"`  // Directories to link as a whole (relative to this config's location)
-	Hooks         *Hooks        `json:"hooks,omitempty"`
-	Repos         []RepoConfig  `json:"repos,omitempty"`        // Git repositories to manage
+	Version             string                       `json:"version,omitempty"`
+	PathMappings        []PathMapping                `json:"pathMappings,omitempty"`
+	FileMappings        []PathMapping                `json:"fileMappings,omitempty"` // Files to copy (not symlink) for consistency
+	Exclude             []Conditional                `json:"exclude,omitempty"`
+	LinkFolders         []Conditional                `json:"linkFolders,omitempty"`  // Directories to link as a whole (relative to this config's location)
+	MergeFolders        []Conditional                `json:"mergeFolders,omitempty"` // Directories whose files are merged across layers instead of linked as a whole
+	Hooks               *Hooks                       `json:"hooks,omitempty"`
+	Repos               []RepoConfig                 `json:"repos,omitempty"`               // Git repositories to manage
+	RequireConfirm      bool                         `json:"requireConfirm,omitempty"`      // Links from this source need explicit confirmation to apply
+	Layout              string                       `json:"layout,omitempty"`              // "flat": the source root maps to $HOME (no home/root subdirectories)
+	Ownership           map[string]string            `json:"ownership,omitempty"`           // Glob (relative to the target's base, $HOME or /) -> expected "user[:group]" of targets
+	Permissions         map[string]string            `json:"permissions,omitempty"`         // Glob (relative to the target's base, $HOME or /) -> octal mode, e.g. "600"
+	DirPermissions      map[string]string            `json:"dirPermissions,omitempty"`      // Subtree (relative to this config's location) -> octal mode of created parent dirs
+	IncludeHidden       *bool                        `json:"includeHidden,omitempty"`       // false: skip every hidden file and directory (default true)
+	ExcludeNestedHidden bool                         `json:"excludeNestedHidden,omitempty"` // Skip hidden entries below the top level of home/root (keeps ~/.bashrc, drops ~/.config/x/.cache)
+	TargetExclude       []string                     `json:"targetExclude,omitempty"`       // Globs matched against computed target paths, e.g. "~/.cache/**"
+	ShellSpecific       bool                         `json:"shellSpecific,omitempty"`       // Only link shell rc files (.bashrc, .zshrc, ...) of the $SHELL login shell
+	NoBackup            []string                     `json:"noBackup,omitempty"`            // Target globs never backed up, even with --backup
+	AlwaysBackup        []string                     `json:"alwaysBackup,omitempty"`        // Target globs always backed up, even without --backup
+	ExcludeExtensions   []string                     `json:"excludeExtensions,omitempty"`   // File extensions skipped case-insensitively, e.g. ".orig"
+	NoRecurse           []string                     `json:"noRecurse,omitempty"`           // Directory name globs never searched for nested configs (adds to DefaultNoRecurse)
+	ExcludeCmd          string                       `json:"excludeCmd,omitempty"`          // Predicate run per source file ({{path}} is replaced); a non-zero exit excludes the file
+	Xattrs              map[string]map[string]string `json:"xattrs,omitempty"`              // Glob (relative to the target's base, $HOME or /) -> extended attribute -> value expected on the target
+}
+
+// HostGroups is the $CDM_BASE/hostgroups.json file, which lets several
+// hosts share one host-specific layer
+type HostGroups struct {
+	Groups []HostGroup `json:"groups"`
+}
+
+// HostGroup maps hostnames to a layer directory in CDM_BASE
+type HostGroup struct {
+	Layer string   `json:"layer"` // Directory name in CDM_BASE, e.g. "laptops"
+	Hosts []string `json:"hosts"` // Hostnames or glob patterns such as "thinkpad-*"
 }
 
 // PathMapping defines a source-to-target path mapping rule
 type PathMapping struct {
 	Source string `json:"source"`
 	Target string `json:"target"`
+	When   *When  `json:"when,omitempty"` // Only apply the mapping when the predicate holds
+}
+
+// When is a predicate gating a config rule
+type When struct {
+	Env map[string]string `json:"env,omitempty"` // Every variable must be set to the given value
+}
+
+// Conditional is a string rule (an exclude pattern or linkFolders path)
+// that may be gated by a when predicate. In JSON it is either a plain
+// string or {"value": "...", "when": {...}}.
+type Conditional struct {
+	Value string `json:"value"`
+	When  *When  `json:"when,omitempty"`
+}
+
+// UnmarshalJSON accepts both the plain string and the object form
+func (c *Conditional) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		c.When = nil
+		return json.Unmarshal(data, &c.Value)
+	}
+	type plain Conditional
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// MarshalJSON writes unconditional rules as plain strings
+func (c Conditional) MarshalJSON() ([]byte, error) {
+	if c.When == nil {
+		return json.Marshal(c.Value)
+	}
+	type plain Conditional
+	return json.Marshal(plain(c))
 }
 
 // Hooks defines commands to run before and after applying
 type Hooks struct {
-	PreApply  string `json:"preApply,omitempty"`
-	PostApply string `json:"postApply,omitempty"`
+	PreApply  string   `json:"preApply,omitempty"`
+	PostApply string   `json:"postApply,omitempty"`
+	When      []string `json:"when,omitempty"` // Target globs; hooks run only if a changed link's target matches one
+}
+
+// HookSet holds the hooks declared by one config file, scoped to its directory
+type HookSet struct {
+	Dir       string   `json:"dir"` // Directory containing the config; hooks run only if links from here change
+	PreApply  string   `json:"preApply,omitempty"`
+	PostApply string   `json:"postApply,omitempty"`
+	When      []string `json:"when,omitempty"` // Target globs from hooks.when, expanded to absolute paths
 }
 
 // RepoConfig represents a git repository configuration
 type RepoConfig struct {
-	Path   string `json:"path"`            // Relative path from config file location
-	URL    string `json:"url"`             // Clone URL (required)
-	Branch string `json:"branch"`          // Target branch (required)
+	Path   string `json:"path"`             // Relative path from config file location
+	URL    string `json:"url"`              // Clone URL (required)
+	Branch string `json:"branch"`           // Target branch (required)
 	Remote string `json:"remote,omitempty"` // Remote name (default: origin)
 }
 
+// PlanVersion is the plan file format version written by this build
+const PlanVersion = "1.2.0"
+
 // Plan represents the execution plan structure
 type Plan struct {
 	Version   string       `json:"version"`
 	Timestamp time.Time    `json:"timestamp"`
 	Hostname  string       `json:"hostname"`
+	Comment   string       `json:"comment,omitempty"` // Free-form human annotation
+	Root      string       `json:"root,omitempty"`    // Alternate root the root base was resolved to
 	Sources   []string     `json:"sources"`
 	Links     []Link       `json:"links"`
 	Repos     []RepoConfig `json:"repos,omitempty"`
+	Hooks     []HookSet    `json:"hooks,omitempty"`
 	Stats     Stats        `json:"stats"`
+
+	Requirements *Requirements `json:"requirements,omitempty"` // What apply needs from the system
+}
+
+// Requirements lists what a plan needs from the system it is applied on
+type Requirements struct {
+	Commands []string `json:"commands,omitempty"` // Executables run by hooks (names on PATH or absolute paths)
+	Sudo     bool     `json:"sudo,omitempty"`     // Some targets are in system directories
 }
 
 // Link represents a single deployment operation (symlink or copy)
 type Link struct {
-	Source string `json:"source"`
-	Target string `json:"target"`
-	Action string `json:"action"` // "link" | "copy"
-	Reason string `json:"reason"` // "new" | "override from <name>" | "file mapping"
+	Source         string            `json:"source"`
+	Target         string            `json:"target"`
+	Action         string            `json:"action"`                   // "link" | "copy" | "hardlink" | "mkdir"
+	Reason         string            `json:"reason"`                   // "new" | "override from <name>" | "file mapping"
+	RequireConfirm bool              `json:"requireConfirm,omitempty"` // Set when the source config has requireConfirm
+	Owner          string            `json:"owner,omitempty"`          // Expected "user[:group]" of the target, from ownership config
+	Mode           string            `json:"mode,omitempty"`           // Octal mode enforced on the source (links) or target (copies)
+	DirMode        string            `json:"dirMode,omitempty"`        // Octal mode for parent directories created for the target
+	Backup         string            `json:"backup,omitempty"`         // "always" | "never": overrides --backup for this target
+	Xattrs         map[string]string `json:"xattrs,omitempty"`         // Extended attributes expected on the target itself, e.g. security.selinux
 }
 
+// Link backup overrides (Link.Backup)
+const (
+	BackupAlways = "always"
+	BackupNever  = "never"
+)
+
 // Stats contains execution statistics
 type Stats struct {
 	Total    int `json:"total"`
@@ -61,12 +160,19 @@ type Stats struct {
 	Skip     int `json:"skip"`
 }
 
+// PlanSummary is the machine-readable plan summary printed by plan --summary-json
+type PlanSummary struct {
+	Stats
+	DurationMs int64 `json:"durationMs"`
+}
+
 // FileEntry represents a file discovered during scanning
 type FileEntry struct {
 	Source     string // Absolute source path
 	Target     string // Absolute target path
 	SourcePath string // Source directory this file belongs to
 	Reason     string // Reason for inclusion
+	EmptyDir   bool   // Source is an empty directory to recreate at the target
 }
 
 // GlobalOptions holds global CLI options
@@ -77,38 +183,149 @@ type GlobalOptions struct {
 	CdmBase string
 }
 
+// PlanOptions holds options for plan generation
+type PlanOptions struct {
+	Root     string // Alternate root directory the "root" base resolves to (default: /)
+	RootHome bool   // Also place "home" base targets under Root
+	Flat     bool   // Treat every source root as the home base
+
+	ModifiedAfter  time.Time // Only include files modified after this time (zero: no limit)
+	ModifiedBefore time.Time // Only include files modified before this time (zero: no limit)
+
+	RespectGitignore bool          // Skip files ignored by the source repository's .gitignore files
+	SinceCommit      string        // Only include files changed since this git ref
+	Hardlink         bool          // Plan hard links instead of symlinks for files
+	StripPrefix      string        // Directory inside each source that holds the home/root bases
+	Base             string        // "home" or "root": only plan targets of that base (empty: both)
+	IncludeEmptyDirs bool          // Plan mkdir entries for source directories without any entries
+	Concurrency      int           // Maximum excludeCmd predicates run at once (0: one per CPU)
+	NoRemap          bool          // Skip pathMappings, to compare raw and remapped plans
+	SourceConfig     string        // Config file merged into the root config of every source
+	Strict           bool          // Fail instead of warning when source paths cannot be read
+	TargetMap        string        // JSON file of source file -> target overrides applied after pathMappings
+	AllowExcludeCmd  bool          // Run excludeCmd predicates; configs that set one are refused otherwise
+	Timeout          time.Duration // Kill excludeCmd predicates running longer than this (0: no limit)
+}
+
 // ApplyOptions holds options for the apply operation
 type ApplyOptions struct {
-	DryRun  bool
-	Backup  bool
-	Verbose bool
+	DryRun        bool
+	Backup        bool
+	BackupStyle   string // Backup naming: "suffix" (default), "tilde" or "dir"
+	Verbose       bool
+	Yes           bool          // Skip confirmation for links that require it
+	NoLock        bool          // Don't take the exclusive apply lock
+	Frozen        bool          // Fail instead of removing or overwriting existing targets
+	Force         bool          // Replace directories that block a file target (moved aside as a backup)
+	KeepGoing     bool          // Continue after a link fails instead of stopping at the first failure
+	DirMode       string        // Octal mode for created parent directories (default 755)
+	Confirm       bool          // Show a summary of operations and prompt before applying
+	PrivilegeTool string        // Backend for privileged operations: sudo (default), doas, none
+	Report        string        // Write an ApplyResult JSON to this path after applying
+	Timeout       time.Duration // Kill hooks and privileged commands running longer than this (0: no limit)
+	AllowSystem   bool          // Apply links to system paths without the interactive confirmation
+	FailMissing   bool          // Treat a missing link source as a failed link instead of skipping it
+	VerifyDryRun  bool          // Check each link's dry-run classification against what apply did
+	LogPrefix     string        // Prefix of a link's output lines, e.g. "[3/10] " (set by apply per link)
+	SetXattrs     bool          // Set the configured extended attributes on targets after linking
+}
+
+// Link outcomes recorded in an ApplyResult
+const (
+	OutcomeApplied   = "applied"   // Target was created or replaced
+	OutcomeUnchanged = "unchanged" // Target was already correct
+	OutcomeSkipped   = "skipped"   // Link was not attempted
+	OutcomeFailed    = "failed"    // Link could not be applied
+)
+
+// LinkResult records what an apply did for a single link
+type LinkResult struct {
+	Source         string        `json:"source"`
+	Target         string        `json:"target"`
+	Action         string        `json:"action"`
+	Outcome        string        `json:"outcome"`
+	Error          string        `json:"error,omitempty"`
+	Backup         string        `json:"backup,omitempty"`   // Backup created before replacing the target
+	Replaced       bool          `json:"replaced,omitempty"` // The target existed before it was applied
+	Duration       time.Duration `json:"durationNs"`
+	ReplacedSHA256 string        `json:"replacedSha256,omitempty"` // Content hash of a real file the target replaced
+}
+
+// Overwrite records a real (non-link) file an apply replaced, so users can
+// review what was overwritten, with or without a backup
+type Overwrite struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Source string    `json:"source"`
+	SHA256 string    `json:"sha256"`           // Hash of the replaced content
+	Backup string    `json:"backup,omitempty"` // Backup made before replacing, if any
+}
+
+// ApplyResult is the structured record of an apply run
+type ApplyResult struct {
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt time.Time    `json:"finishedAt"`
+	Hostname   string       `json:"hostname"`
+	DryRun     bool         `json:"dryRun"`
+	Total      int          `json:"total"`
+	Success    int          `json:"success"`
+	Skipped    int          `json:"skipped"`
+	Links      []LinkResult `json:"links"`
+	Errors     []string     `json:"errors,omitempty"`
 }
 
 // LinkStatus represents the status of a link check
 type LinkStatus string
 
 const (
-	StatusOK           LinkStatus = "OK"            // Symlink/copy exists and is correct
-	StatusMissing      LinkStatus = "MISSING"       // Target does not exist
-	StatusWrongLink    LinkStatus = "WRONG_LINK"   // Target is symlink but points to wrong source
-	StatusNotSymlink   LinkStatus = "NOT_SYMLINK"  // Target exists but is not a symlink
+	StatusOK            LinkStatus = "OK"             // Symlink/copy exists and is correct
+	StatusMissing       LinkStatus = "MISSING"        // Target does not exist
+	StatusWrongLink     LinkStatus = "WRONG_LINK"     // Target is symlink but points to wrong source
+	StatusNotSymlink    LinkStatus = "NOT_SYMLINK"    // Target exists but is not a symlink
 	StatusSourceMissing LinkStatus = "SOURCE_MISSING" // Source file does not exist
-	StatusMismatch     LinkStatus = "MISMATCH"     // Copy target content differs from source
+	StatusMismatch      LinkStatus = "MISMATCH"       // Copy target content differs from source
+	StatusParentMissing LinkStatus = "PARENT_MISSING" // Target's parent directory does not exist
+	StatusWrongOwner    LinkStatus = "WRONG_OWNER"    // Target owner differs from configured ownership
+	StatusTargetIsDir   LinkStatus = "TARGET_IS_DIR"  // Target is a directory but the source is a file
+	StatusWrongMode     LinkStatus = "WRONG_MODE"     // Permissions differ from the permissions config
+	StatusDangling      LinkStatus = "DANGLING"       // Link is correct but following it reaches nothing readable
+	StatusEmpty         LinkStatus = "EMPTY"          // Link is correct but the resolved file is zero-byte
+	StatusNotHardlink   LinkStatus = "NOT_HARDLINK"   // Target exists but is not the same file as the source
+	StatusWrongXattr    LinkStatus = "WRONG_XATTR"    // Target's extended attributes differ from the xattrs config
 )
 
 // CheckResult represents the result of checking a single link
- type CheckResult struct {
-	Link   Link
-	Status LinkStatus
-	Detail string // Additional detail (e.g., actual link target if wrong)
+type CheckResult struct {
+	Link     Link       `json:"link"`
+	Status   LinkStatus `json:"status"`
+	Detail   string     `json:"detail,omitempty"`   // Additional detail (e.g., actual link target if wrong)
+	Resolved string     `json:"resolved,omitempty"` // Fully resolved real path of the target (check --resolve)
 }
 
 // CheckReport represents the full check report
- type CheckReport struct {
-	Total    int
-	ByStatus map[LinkStatus]int
-	Results  []CheckResult
-	AllOK    bool
+type CheckReport struct {
+	Hostname string             `json:"hostname,omitempty"`
+	Home     string             `json:"home,omitempty"` // $HOME of the checked system, used to compare reports across machines
+	Total    int                `json:"total"`
+	ByStatus map[LinkStatus]int `json:"byStatus"`
+	Results  []CheckResult      `json:"results"`
+	AllOK    bool               `json:"allOK"`
+}
+
+// LinkSnapshot records the state of every managed target at one point in
+// time (check --export), for detecting drift later (check --compare-to)
+type LinkSnapshot struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Hostname  string           `json:"hostname"`
+	Targets   []TargetSnapshot `json:"targets"`
+}
+
+// TargetSnapshot is the recorded state of one target
+type TargetSnapshot struct {
+	Target   string     `json:"target"`
+	Source   string     `json:"source"`
+	Readlink string     `json:"readlink,omitempty"` // Raw symlink value; empty if the target is not a symlink
+	Status   LinkStatus `json:"status"`
 }
 
 // RepoStatus represents the status of a repo check